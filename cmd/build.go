@@ -5,7 +5,7 @@ package cmd
 // This command is used by instructors to prepare challenge folders for distribution.
 //
 // Workflow:
-// 1. Validates the folder structure to ensure it contains properly defined levels and check scripts.
+// 1. Validates the folder structure to ensure it contains properly defined levels, check scripts and challenge.yaml.
 // 2. Packages the folder into a compressed archive (e.g., .tar.gz).
 // 3. Encrypts the archive with a starter key and an unlock time.
 //    - The starter key will be given to students at test start time.
@@ -14,21 +14,45 @@ package cmd
 //
 // Flags:
 // -f, --folder        Path to the challenge folder to be packaged (required).
-// -p, --password 		 Password used for encrypt the archive (required)
+// -p, --password 		 Password used for encrypt the archive (required, unless the archive is built for recipients)
+//     --recipient     Public key of a student the archive is built for, instead of a password, repeatable
+//     --roster        File of "<student id> <public key>" lines the archive is built for, instead of a password
 // -k, --key           Starter key used for encryption (required).
-// -u, --unlock-time   Unlock time in human-friendly format: "YYYY-MM-DD HH:MM" (24-hour clock) (required).
+// -u, --unlock-time   Unlock time in RFC 3339 or human-friendly format: "YYYY-MM-DD HH:MM" (24-hour clock) (required).
+//     --timezone      IANA timezone of a human-friendly unlock time (optional, default: the zone of this machine)
+//     --lock-after    Time after which sessions can not be started, same format as --unlock-time (optional)
+//     --window        How long after the unlock time sessions can be started, instead of --lock-after (optional)
 // -o, --output        Path to save the encrypted archive (optional, default: eval-archive.enc)
+// -c, --course        Course name stored unencrypted in the archive header (optional)
+//     --time-server   NTP servers the unlock time is checked against, comma separated (optional, default: pool.ntp.org)
+//     --time-policy   What to do when the time server is unreachable: "require", "fallback" or "local" (optional, default: require)
+//     --network       Network of the sandbox, "loopback" or "veth" (optional, default: the network of challenge.yaml, or loopback)
+//     --namespaces    Namespaces the sandbox is isolated in (optional, default: the namespaces of challenge.yaml, or all of them)
+//     --split-key     Encrypt the challenges with both the password and the starter key (optional)
+//     --sign-key      Private key to sign the archive with, created by `qo keygen` (optional)
+//     --kdf           Password key derivation, "argon2id" or "pbkdf2" (optional, default: argon2id)
+//     --argon2-time   Argon2id passes over the memory (optional, default: 3)
+//     --argon2-memory Argon2id memory in MiB (optional, default: 64)
+//     --argon2-threads Argon2id parallelism (optional, default: 4)
 //
 // Usage Example:
 // qo build -f ./challenges -p foo -k bar -u "2025-07-10 09:30" -o ./test.enc
 
 import (
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"fmt"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/ahmedYasserM/qo/pkg/archive"
+	"github.com/ahmedYasserM/qo/pkg/clock"
+	"github.com/ahmedYasserM/qo/pkg/keys"
 	"github.com/ahmedYasserM/qo/pkg/logger"
+	"github.com/ahmedYasserM/qo/pkg/manifest"
+	"github.com/ahmedYasserM/qo/pkg/sandbox"
 	"github.com/spf13/cobra"
 )
 
@@ -37,24 +61,171 @@ var (
 	password         string
 	utKey            string
 	unlockTime       string
+	timezone         string
+	lockAfter        string
+	window           time.Duration
 	outputArchiveDir string
+	course           string
+	kdfName          string
+	argon2Time       uint32
+	argon2Memory     uint32
+	argon2Threads    uint8
+	timeServer       string
+	timePolicy       string
+	signKeyPath      string
+	recipientPaths   []string
+	rosterPath       string
+	splitKey         bool
+	network          string
+	namespaceNames   []string
 )
 
 var buildCmd = &cobra.Command{
 	Use:   "build",
 	Short: "Package and encrypt a challenge folder for student testing",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		layout := "2006-01-02 15:04"
-		_, err := time.Parse(layout, unlockTime)
+		unlockAt, err := archive.ParseUnlockTime(unlockTime, timezone)
 		if err != nil {
 			return err
 		}
 
+		logger.Info(fmt.Sprintf("The archive unlocks at %s (%s).", unlockAt.Format("2006-01-02 15:04 MST"), unlockAt.UTC().Format("2006-01-02 15:04 MST")))
+
+		var lockAt time.Time
+		switch {
+		case lockAfter != "":
+			if lockAt, err = archive.ParseUnlockTime(lockAfter, timezone); err != nil {
+				return err
+			}
+		case window != 0:
+			lockAt = unlockAt.Add(window)
+		}
+
+		if !lockAt.IsZero() {
+			logger.Info(fmt.Sprintf("Sessions can not be started after %s (%s).", lockAt.In(unlockAt.Location()).Format("2006-01-02 15:04 MST"), lockAt.UTC().Format("2006-01-02 15:04 MST")))
+		}
+
 		if err := archive.IsValidFolderStructure(folderPath); err != nil {
 			return err
 		}
 
-		if err := archive.CreateEncryptedTarArchive(folderPath, outputArchiveDir, unlockTime, password, utKey); err != nil {
+		var kdf archive.KDFParams
+		switch kdfName {
+		case "argon2id":
+			kdf = archive.KDFParams{
+				Algorithm: archive.KDFArgon2id,
+				Time:      argon2Time,
+				Memory:    argon2Memory * 1024,
+				Threads:   argon2Threads,
+			}
+		case "pbkdf2":
+			kdf = archive.PBKDF2Defaults
+		default:
+			return fmt.Errorf("unknown key derivation %q, expected \"argon2id\" or \"pbkdf2\"", kdfName)
+		}
+
+		policy, err := clock.ParsePolicy(timePolicy)
+		if err != nil {
+			return err
+		}
+
+		servers := clock.SplitServers(timeServer)
+		if len(servers) == 0 && policy != clock.PolicyLocal {
+			return fmt.Errorf("the %s time policy needs a time server", policy)
+		}
+		timeServer = strings.Join(servers, ",")
+
+		// The sandbox of the manifest, unless the flags replace it
+		challengeManifest, err := manifest.Load(folderPath)
+		if err != nil {
+			return err
+		}
+		if challengeManifest != nil {
+			if !cmd.Flags().Changed("network") {
+				network = string(challengeManifest.Network)
+			}
+			if !cmd.Flags().Changed("namespaces") {
+				namespaceNames = challengeManifest.Namespaces
+			}
+		}
+
+		sandboxNetwork, err := sandbox.ParseNetwork(network)
+		if err != nil {
+			return err
+		}
+
+		// Archives isolated in every namespace do not list them
+		var namespaces []sandbox.Namespace
+		if len(namespaceNames) > 0 {
+			if namespaces, err = sandbox.ParseNamespaces(namespaceNames); err != nil {
+				return err
+			}
+
+			if sandboxNetwork == sandbox.NetworkVeth && !slices.Contains(namespaces, sandbox.NamespaceNet) {
+				return fmt.Errorf("the %s network needs the %s namespace", sandbox.NetworkVeth, sandbox.NamespaceNet)
+			}
+		}
+
+		// Archives without limits get the defaults of qo start
+		var limits *sandbox.Limits
+		if challengeManifest != nil {
+			manifestLimits, err := challengeManifest.Limits.Sandbox()
+			if err != nil {
+				return fmt.Errorf("invalid limits in %s: %w", manifest.FileName, err)
+			}
+			if !manifestLimits.IsZero() {
+				limits = &manifestLimits
+			}
+		}
+
+		var signingKey ed25519.PrivateKey
+		if signKeyPath != "" {
+			if signingKey, err = keys.ReadSigningKey(signKeyPath); err != nil {
+				return err
+			}
+		}
+
+		var recipients []*ecdh.PublicKey
+		for _, path := range recipientPaths {
+			recipient, err := keys.ReadRecipient(path)
+			if err != nil {
+				return err
+			}
+			recipients = append(recipients, recipient)
+		}
+
+		if rosterPath != "" {
+			roster, err := keys.ReadRoster(rosterPath)
+			if err != nil {
+				return err
+			}
+			recipients = append(recipients, roster...)
+		}
+
+		if len(recipients) > 0 {
+			logger.Info(fmt.Sprintf("The archive is built for %d students.", len(recipients)))
+		}
+
+		opts := archive.EncryptOptions{
+			UnlockTime: unlockAt,
+			LockTime:   lockAt,
+			Password:   password,
+			StarterKey: utKey,
+			Metadata: archive.Metadata{
+				Course:     course,
+				TimeServer: timeServer,
+				TimePolicy: policy,
+				Network:    sandboxNetwork,
+				Namespaces: namespaces,
+				Limits:     limits,
+			},
+			KDF:        kdf,
+			SigningKey: signingKey,
+			Recipients: recipients,
+			SplitKey:   splitKey,
+		}
+
+		if err := archive.CreateEncryptedTarArchive(folderPath, outputArchiveDir, opts); err != nil {
 			logger.Error(err)
 			return err
 		}
@@ -70,13 +241,32 @@ func init() {
 
 	// Flags
 	buildCmd.Flags().StringVarP(&folderPath, "folder", "f", "", "Path to the challenge folder to be packaged (required)")
-	buildCmd.Flags().StringVarP(&password, "password", "p", "", "Password used for encrypt the archive (required)")
+	buildCmd.Flags().StringVarP(&password, "password", "p", "", "Password used for encrypt the archive (required, unless built for recipients)")
+	buildCmd.Flags().StringSliceVar(&recipientPaths, "recipient", nil, "Public key of a student the archive is built for, created by qo keygen --type identity")
+	buildCmd.Flags().StringVar(&rosterPath, "roster", "", "File of \"<student id> <public key>\" lines the archive is built for")
 	buildCmd.Flags().StringVarP(&utKey, "key", "k", "", "Starter key used for encryption (required)")
-	buildCmd.Flags().StringVarP(&unlockTime, "unlock-time", "u", "", "Unlock time in human-friendly format: \"YYYY-MM-DD HH:MM\" (24-hour clock) (required)")
+	buildCmd.Flags().StringVarP(&unlockTime, "unlock-time", "u", "", "Unlock time in RFC 3339 or human-friendly format: \"YYYY-MM-DD HH:MM\" (24-hour clock) (required)")
+	buildCmd.Flags().StringVar(&timezone, "timezone", "Local", "IANA timezone of a human-friendly unlock time (e.g., Africa/Cairo), the zone of this machine by default")
+	buildCmd.Flags().StringVar(&lockAfter, "lock-after", "", "Time after which sessions can not be started, in the same format as --unlock-time")
+	buildCmd.Flags().DurationVar(&window, "window", 0, "How long after the unlock time sessions can be started (e.g., 30m, 2h)")
 	buildCmd.Flags().StringVarP(&outputArchiveDir, "output", "o", "eval-archive.enc", "Path to save the encrypted archive")
+	buildCmd.Flags().StringVarP(&course, "course", "c", "", "Course name stored unencrypted in the archive header")
+	buildCmd.Flags().StringVar(&timeServer, "time-server", "pool.ntp.org", "NTP servers the unlock time is checked against, comma separated, most of their answers have to agree")
+	buildCmd.Flags().StringVar(&timePolicy, "time-policy", "require", "When the time server can not be reached: \"require\" refuses to unlock, \"fallback\" uses the local clock, \"local\" never asks the server")
+	buildCmd.Flags().StringSliceVar(&namespaceNames, "namespaces", nil, "Namespaces the sandbox is isolated in, among uts, pid, mount, net, ipc and cgroup (default: the namespaces of challenge.yaml, or all of them)")
+	buildCmd.Flags().StringVar(&network, "network", "", "Network of the sandbox: \"loopback\" isolates it, \"veth\" links it to services on the host (default: the network of challenge.yaml, or loopback)")
+	buildCmd.Flags().BoolVar(&splitKey, "split-key", false, "Encrypt the challenges with both the password and the starter key, so the password alone can not open them")
+	buildCmd.Flags().StringVar(&signKeyPath, "sign-key", "", "Private key to sign the archive with, created by qo keygen")
+	buildCmd.Flags().StringVar(&kdfName, "kdf", "argon2id", "Password key derivation, \"argon2id\" or \"pbkdf2\"")
+	buildCmd.Flags().Uint32Var(&argon2Time, "argon2-time", archive.Argon2idDefaults.Time, "Argon2id passes over the memory")
+	buildCmd.Flags().Uint32Var(&argon2Memory, "argon2-memory", archive.Argon2idDefaults.Memory/1024, "Argon2id memory in MiB")
+	buildCmd.Flags().Uint8Var(&argon2Threads, "argon2-threads", archive.Argon2idDefaults.Threads, "Argon2id parallelism")
 
 	buildCmd.MarkFlagRequired("folder")
-	buildCmd.MarkFlagRequired("password")
+	buildCmd.MarkFlagsOneRequired("password", "recipient", "roster")
+	buildCmd.MarkFlagsMutuallyExclusive("password", "recipient")
+	buildCmd.MarkFlagsMutuallyExclusive("password", "roster")
 	buildCmd.MarkFlagRequired("key")
 	buildCmd.MarkFlagRequired("unlock-time")
+	buildCmd.MarkFlagsMutuallyExclusive("lock-after", "window")
 }
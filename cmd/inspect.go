@@ -0,0 +1,179 @@
+package cmd
+
+// inspect.go - Instructor Command
+//
+// This command shows what an encrypted archive contains, without extracting it.
+//
+// Workflow:
+// 1. Reads the archive header: format version, key derivation, cipher, flags and public metadata.
+// 2. Decrypts the archive in memory, no sandbox is extracted.
+// 3. Prints the unlock and lock times when the starter key is given.
+// 4. Lists the levels and every file with its mode and size.
+//
+// Flags:
+// -a, --archive       Path to the encrypted archive file (required).
+// -p, --password      Password used to encrypt the archive (required, unless --identity is given)
+//     --identity      Student private key, for archives built for each student (required, unless --password is given)
+// -k, --key           Starter key, to show the unlock time (optional, required for split-key archives)
+//     --verify-key    Instructor public key the archive must be signed with (optional)
+//
+// Usage Example:
+// qo inspect -a ./test.enc -p foo -k bar
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ahmedYasserM/qo/pkg/archive"
+	"github.com/ahmedYasserM/qo/pkg/keys"
+	"github.com/spf13/cobra"
+)
+
+var (
+	inspectArchivePath   string
+	inspectPassword      string
+	inspectIdentityPath  string
+	inspectStarterKey    string
+	inspectVerifyKeyPath string
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Show the metadata and the files of an encrypted archive without extracting it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := archive.DecryptOptions{
+			Password:   inspectPassword,
+			StarterKey: inspectStarterKey,
+		}
+
+		var err error
+		if inspectIdentityPath != "" {
+			if opts.Identity, err = keys.ReadIdentity(inspectIdentityPath); err != nil {
+				return err
+			}
+		}
+
+		if inspectVerifyKeyPath != "" {
+			if opts.VerifyKey, err = keys.ReadVerifyKey(inspectVerifyKeyPath); err != nil {
+				return err
+			}
+		}
+
+		inspection, err := archive.Inspect(inspectArchivePath, opts)
+		if err != nil {
+			return err
+		}
+
+		printInspection(inspection, opts.VerifyKey)
+
+		return nil
+	},
+}
+
+func printInspection(inspection *archive.Inspection, verifyKey ed25519.PublicKey) {
+	header := inspection.Header
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Archive:\t%s\n", inspectArchivePath)
+	fmt.Fprintf(w, "Format version:\t%d\n", header.Version)
+	fmt.Fprintf(w, "Key derivation:\t%s\n", header.KDF)
+	if header.Cipher == archive.CipherAES256CTR {
+		fmt.Fprintf(w, "Cipher:\tAES-256-CTR, not authenticated\n")
+	} else {
+		fmt.Fprintf(w, "Cipher:\tAES-256-GCM in 64 KiB chunks\n")
+	}
+
+	encryption := "password"
+	if header.Flags&archive.FlagRecipients != 0 {
+		encryption = fmt.Sprintf("%d students", len(header.Recipients))
+	}
+	if header.Flags&archive.FlagSplitKey != 0 {
+		encryption += ", split with the starter key"
+	}
+	fmt.Fprintf(w, "Encrypted for:\t%s\n", encryption)
+
+	switch {
+	case header.Flags&archive.FlagSigned == 0:
+		fmt.Fprintf(w, "Signature:\tnone\n")
+	case verifyKey != nil:
+		fmt.Fprintf(w, "Signature:\tvalid\n")
+	default:
+		fmt.Fprintf(w, "Signature:\tsigned, not verified (use --verify-key)\n")
+	}
+
+	if header.Metadata.Course != "" {
+		fmt.Fprintf(w, "Course:\t%s\n", header.Metadata.Course)
+	}
+
+	if header.Metadata.TimePolicy != "" {
+		fmt.Fprintf(w, "Time check:\t%s, server %s\n", header.Metadata.TimePolicy, header.Metadata.TimeServer)
+	}
+
+	if header.Metadata.Network != "" {
+		fmt.Fprintf(w, "Network:\t%s\n", header.Metadata.Network)
+	}
+
+	if len(header.Metadata.Namespaces) > 0 {
+		var names []string
+		for _, namespace := range header.Metadata.Namespaces {
+			names = append(names, string(namespace))
+		}
+		fmt.Fprintf(w, "Namespaces:\t%s\n", strings.Join(names, ", "))
+	}
+
+	if header.Metadata.Limits != nil {
+		fmt.Fprintf(w, "Limits:\t%s\n", header.Metadata.Limits)
+	}
+
+	if inspection.UnlockTime.IsZero() {
+		fmt.Fprintf(w, "Unlock time:\tunknown, give the starter key with -k\n")
+	} else {
+		fmt.Fprintf(w, "Unlock time:\t%s\n", formatInstant(inspection.UnlockTime))
+
+		if !inspection.LockTime.IsZero() {
+			fmt.Fprintf(w, "Lock time:\t%s\n", formatInstant(inspection.LockTime))
+		}
+	}
+
+	fmt.Fprintf(w, "Levels:\t%s\n", strings.Join(inspection.Levels(), ", "))
+	w.Flush()
+
+	fmt.Println()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "MODE\tSIZE\t NAME\n")
+	for _, entry := range inspection.Entries {
+		name := entry.Name
+		if entry.Linkname != "" {
+			name += " -> " + entry.Linkname
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t %s\n", entry.Mode, entry.Size, name)
+	}
+	w.Flush()
+}
+
+// formatInstant shows t in the local zone and in UTC
+func formatInstant(t time.Time) string {
+	return fmt.Sprintf("%s (%s)", t.Local().Format("2006-01-02 15:04 MST"), t.UTC().Format("2006-01-02 15:04 MST"))
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+
+	// Flags
+	inspectCmd.Flags().StringVarP(&inspectArchivePath, "archive", "a", "", "Path to the encrypted archive file (required)")
+	inspectCmd.Flags().StringVarP(&inspectPassword, "password", "p", "", "Password used to encrypt the archive (required, unless --identity is given)")
+	inspectCmd.Flags().StringVar(&inspectIdentityPath, "identity", "", "Student private key, for archives built for each student")
+	inspectCmd.Flags().StringVarP(&inspectStarterKey, "key", "k", "", "Starter key, to show the unlock time (required for split-key archives)")
+	inspectCmd.Flags().StringVar(&inspectVerifyKeyPath, "verify-key", "", "Instructor public key the archive must be signed with")
+
+	inspectCmd.MarkFlagRequired("archive")
+	inspectCmd.MarkFlagsOneRequired("password", "identity")
+	inspectCmd.MarkFlagsMutuallyExclusive("password", "identity")
+}
@@ -0,0 +1,82 @@
+package cmd
+
+// keygen.go - Instructor and Student Command
+//
+// This command creates the key pairs used with archives.
+//
+// Workflow:
+// 1. Generates a key pair of the requested type:
+//    - signing: an Ed25519 key pair instructors sign their archives with.
+//    - identity: an X25519 key pair a student opens archives built for them with.
+// 2. Writes the private key to <output>.key and the public key to <output>.pub, never overwriting existing files.
+// 3. Prints the public key in the form it is shared in: embedded in qo for signing keys, a roster line for identities.
+//
+// Flags:
+// -t, --type          Key type, "signing" or "identity" (optional, default: signing)
+// -o, --output        Path prefix of the key files (optional, default: qo-<type>)
+//
+// Usage Example:
+// qo keygen -o ./instructor
+// qo keygen -t identity -o ./2021170034
+
+import (
+	"fmt"
+
+	"github.com/ahmedYasserM/qo/pkg/keys"
+	"github.com/ahmedYasserM/qo/pkg/logger"
+	"github.com/spf13/cobra"
+)
+
+var (
+	keyType   string
+	keyOutput string
+)
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a key pair to sign or open challenge archives",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if keyOutput == "" {
+			keyOutput = "qo-" + keyType
+		}
+		privatePath, publicPath := keyOutput+".key", keyOutput+".pub"
+
+		var public any
+		var err error
+		switch keyType {
+		case "signing":
+			public, err = keys.GenerateSigningKey(privatePath, publicPath)
+		case "identity":
+			public, err = keys.GenerateIdentity(privatePath, publicPath)
+		default:
+			return fmt.Errorf("unknown key type %q, expected \"signing\" or \"identity\"", keyType)
+		}
+		if err != nil {
+			return err
+		}
+
+		encoded, err := keys.EncodePublicKey(public)
+		if err != nil {
+			return err
+		}
+
+		logger.Success(fmt.Sprintf("Private key saved in %s, keep it secret.", privatePath))
+		logger.Success(fmt.Sprintf("Public key saved in %s.", publicPath))
+
+		if keyType == "signing" {
+			logger.Info(fmt.Sprintf("Students verify archives with `qo start --verify-key %s`, or build qo with the key embedded:\n  go build -ldflags \"-X github.com/ahmedYasserM/qo/cmd.instructorKey=%s\"", publicPath, encoded))
+		} else {
+			logger.Info(fmt.Sprintf("Send %s to your instructor, or this roster line:\n  <student id> %s", publicPath, encoded))
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keygenCmd)
+
+	// Flags
+	keygenCmd.Flags().StringVarP(&keyType, "type", "t", "signing", "Key type, \"signing\" or \"identity\"")
+	keygenCmd.Flags().StringVarP(&keyOutput, "output", "o", "", "Path prefix of the key files (default: qo-<type>)")
+}
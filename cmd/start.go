@@ -8,95 +8,335 @@ package cmd
 // 1. Prompts the student to enter their Student ID (used for reports and logs).
 // 2. Verifies the provided starter key and unlock time to decrypt the archive.
 //    - The test will not start before the scheduled unlock time.
-// 3. Sets up a sandboxed environment using Linux namespaces (isolates processes, users, and filesystem).
+// 3. Sets up a sandboxed environment using Linux namespaces (isolates processes, users, filesystem and network).
+//    - Without root, the sandbox runs in a user namespace whose root is the user running qo, the student's user is mapped to a subordinate id.
 // 4. Extracts the challenge folder into the sandbox and launches an interactive shell for the student.
+//    - The sandbox runs in a cgroup v2 limiting its processes, memory and CPU, when qo runs as root.
 // 5. Monitors activity and logs commands executed by the student.
-// 6. When time ends or the student chooses to finish, generates a single-page PDF report with their results.
+//    - The whole terminal session is recorded in asciicast v2 format.
+//    - Every command line is logged with its time, working directory, exit code and duration.
+//    - Everything is collected in a per-session folder under the output directory.
+// 6. When time ends or the student chooses to finish, runs each level's check.sh inside the sandbox.
+// 7. Generates a single-page PDF report with their results.
 //
 // Flags:
 // -i  --id 			 	 	 Student ID (required)
 // -a, --archive  		 Path to the encrypted archive file (required).
-// -p, --password 		 Password used for encrypt the archive (required)
+// -p, --password 		 Password used for encrypt the archive (required, unless --identity is given)
+//     --identity      Student private key, for archives built for each student (required, unless --password is given)
 // -k, --key           Starter key used for encryption (required).
 // -d, --duration      Total duration of the test in minutes (required).
-// -o, --output        Directory to save logs and PDF report (optional, default: eval-results)
+// -w, --warn-at       Remaining times at which the student is warned (optional, default: 10m,1m)
+// -t, --check-timeout Maximum run time of each level's check script (optional, default: 30s)
+//     --verify-key    Instructor public key the archive must be signed with (required, unless qo was built with one or --allow-unsigned is given)
+//     --allow-unsigned Open archives without checking who built them, when no instructor public key is available (optional)
+//     --allow-shared-user Start rootless sessions without subordinate ids, where the student can read the check scripts (optional)
+// -o, --output        Directory to save the session results bundle (optional, default: eval-results)
+//     --pids-max      Maximum number of processes in the sandbox, 0 for no limit (optional, default: the limits of challenge.yaml, or 1024)
+//     --memory-max    Maximum memory of the sandbox, like 512M or 2G, 0 for no limit (optional, default: the limits of challenge.yaml, or none)
+//     --cpu-max       Number of CPUs the sandbox can keep busy, at least 0.01, 0 for no limit (optional, default: the limits of challenge.yaml, or none)
 //
 // Usage Example:
 // eval start -a ./test.enc -p foo -k bar -d 1h30m -o ./results
 
 import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/ahmedYasserM/qo/pkg/archive"
+	"github.com/ahmedYasserM/qo/pkg/grader"
+	"github.com/ahmedYasserM/qo/pkg/keys"
 	"github.com/ahmedYasserM/qo/pkg/logger"
+	"github.com/ahmedYasserM/qo/pkg/report"
 	"github.com/ahmedYasserM/qo/pkg/sandbox"
+	"github.com/ahmedYasserM/qo/pkg/session"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
 )
 
 var (
-	idStr         string
-	id            uint64
-	archivePath   string
-	utKeyStart    string
-	passwordStart string
-	testDuration  time.Duration
-	outputLogDir  string
+	idStr           string
+	archivePath     string
+	utKeyStart      string
+	passwordStart   string
+	testDuration    time.Duration
+	warnAt          []time.Duration
+	checkTimeout    time.Duration
+	outputLogDir    string
+	verifyKeyPath   string
+	identityPath    string
+	allowUnsigned   bool
+	allowSharedUser bool
+	pidsMax         int64
+	memoryMax       string
+	cpuMax          float64
 )
 
+// instructorKey is the instructor's public key, embedded at build time with
+// -ldflags "-X github.com/ahmedYasserM/qo/cmd.instructorKey=<key>", see `qo keygen`.
+var instructorKey string
+
 var startCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start a test session in a sandboxed environment.",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		// Without root, the sandbox needs unprivileged user namespaces and subordinate ids
+		if err := sandbox.CheckRootless(allowSharedUser); err != nil {
+			if errors.Is(err, sandbox.ErrSharedUser) {
+				return fmt.Errorf("%w. Install the uidmap package and give the user subordinate ids, run qo as root, or start anyway with --allow-shared-user", err)
+			}
+			return err
+		}
 
-		if os.Geteuid() != 0 {
-			logger.Error(fmt.Errorf("this program must be run as root"))
-			os.Exit(1)
+		// This is done to enable user to input id like `093` and parse it as decimal not octal
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			return err
 		}
 
+		verifyKey, err := instructorVerifyKey()
+		if err != nil {
+			return err
+		}
+
+		flags, err := flagLimits()
+		if err != nil {
+			return err
+		}
+
+		// The sandbox is prepared and the archive opened before anything is
+		// written to the results directory: a session that could not start
+		// leaves nothing behind, the student starts again.
 		if err := sandbox.ExtractRootfs(); err != nil {
 			return err
 		}
+		defer removeSandbox()
 
-		if err := archive.DecryptTarArchive(archivePath, passwordStart, utKeyStart); err != nil {
+		challenge, metadata, err := openSessionArchive(verifyKey)
+		if errors.Is(err, archive.ErrLocked) {
+			logger.Warn(fmt.Sprintf("The session can not start yet: %s.", err))
+			return nil
+		}
+		if err != nil {
 			return err
 		}
 
 		logger.Success(fmt.Sprintf("%s folder is unpacked and decrypted successfully.", archivePath))
 
-		err := sandbox.StartSandBox()
+		limits, bestEffort, err := sessionLimits(cmd, flags, metadata.Limits)
+		if err != nil {
+			return err
+		}
+
+		bundle, err := session.Create(outputLogDir, id, archivePath)
+		if err != nil {
+			return err
+		}
+
+		reason, err := runSession(bundle, challenge, metadata, limits, bestEffort)
+
+		bundle.End(string(reason), err)
+
+		if reportErr := report.Generate(bundle); reportErr != nil {
+			logger.Error(fmt.Errorf("could not generate the PDF report: %w", reportErr))
+		}
+
+		if closeErr := bundle.Close(); closeErr != nil {
+			return closeErr
+		}
+
+		logger.Success(fmt.Sprintf("Session results are saved in %s.", bundle.Dir))
 
 		return err
 	},
 }
 
+// openSessionArchive decrypts the archive of the session into the sandbox. It
+// returns the name of the challenge and the metadata of the archive.
+func openSessionArchive(verifyKey ed25519.PublicKey) (string, archive.Metadata, error) {
+	var identity *ecdh.PrivateKey
+	if identityPath != "" {
+		var err error
+		if identity, err = keys.ReadIdentity(identityPath); err != nil {
+			return "", archive.Metadata{}, err
+		}
+	}
+
+	return archive.DecryptTarArchive(archivePath, archive.DecryptOptions{
+		Password:   passwordStart,
+		StarterKey: utKeyStart,
+		VerifyKey:  verifyKey,
+		Identity:   identity,
+	})
+}
+
+// runSession runs the student session in the sandbox holding challenge and
+// records the outcome in the results bundle. limits are enforced as far as
+// the machine allows when bestEffort is set.
+func runSession(bundle *session.Bundle, challenge string, metadata archive.Metadata, limits sandbox.Limits, bestEffort bool) (sandbox.ExitReason, error) {
+	width, height, err := term.GetSize(int(os.Stdin.Fd()))
+	if err != nil || width == 0 || height == 0 {
+		width, height = 80, 24
+	}
+
+	cast, err := bundle.CreateRecording(width, height)
+	if err != nil {
+		return sandbox.ExitError, err
+	}
+
+	commands, err := bundle.CreateCommandLog()
+	if err != nil {
+		cast.Close()
+		return sandbox.ExitError, err
+	}
+
+	var limitReport sandbox.LimitReport
+	cfg := sandbox.Config{
+		Duration:         testDuration,
+		Warnings:         warnAt,
+		Recorder:         cast,
+		Commands:         commands,
+		Network:          metadata.Network,
+		Namespaces:       metadata.Namespaces,
+		Limits:           limits,
+		BestEffortLimits: bestEffort,
+		LimitReport:      &limitReport,
+	}
+	reason, err := sandbox.StartSandBox(cfg)
+	if !limitReport.Limits.IsZero() {
+		bundle.Session.Limits = &limitReport
+	}
+	if closeErr := cast.Close(); err == nil {
+		err = closeErr
+	}
+	// The command log is not worth losing the grades over
+	if closeErr := commands.Close(); closeErr != nil {
+		logger.Error(fmt.Errorf("could not save the command log: %w", closeErr))
+	}
+	if err != nil {
+		return sandbox.ExitError, err
+	}
+
+	if reason == sandbox.ExitTimeout {
+		logger.Info("Session ended: the test duration is over.")
+	} else {
+		logger.Info("Session ended: the shell was closed.")
+	}
+
+	logger.Info("Grading the levels...")
+
+	// Checks run in the sandbox the student had, on its network and with its limits
+	if err := grader.Grade(bundle, challenge, cfg.Check(checkTimeout)); err != nil {
+		return reason, err
+	}
+
+	return reason, nil
+}
+
+// flagLimits returns the resource limits of the flags, or their defaults
+func flagLimits() (sandbox.Limits, error) {
+	memory, err := sandbox.ParseSize(memoryMax)
+	if err != nil {
+		return sandbox.Limits{}, fmt.Errorf("invalid --memory-max: %w", err)
+	}
+
+	limits := sandbox.Limits{PidsMax: pidsMax, MemoryMax: memory, CPUMax: cpuMax}
+	if err := limits.Validate(); err != nil {
+		return sandbox.Limits{}, fmt.Errorf("invalid --pids-max, --memory-max or --cpu-max: %w", err)
+	}
+
+	return limits, nil
+}
+
+// sessionLimits returns the resource limits of the sandbox: the flags that
+// were given, then the limits of the archive, then the defaults of the flags.
+// Only the defaults alone are applied on a best effort basis, limits asked for
+// by the instructor or the flags have to be enforced.
+func sessionLimits(cmd *cobra.Command, limits sandbox.Limits, archiveLimits *sandbox.Limits) (sandbox.Limits, bool, error) {
+	flags := cmd.Flags()
+
+	bestEffort := !flags.Changed("pids-max") && !flags.Changed("memory-max") && !flags.Changed("cpu-max")
+	if archiveLimits == nil || archiveLimits.IsZero() {
+		return limits, bestEffort, nil
+	}
+
+	if !flags.Changed("pids-max") && archiveLimits.PidsMax > 0 {
+		limits.PidsMax = archiveLimits.PidsMax
+	}
+	if !flags.Changed("memory-max") && archiveLimits.MemoryMax > 0 {
+		limits.MemoryMax = archiveLimits.MemoryMax
+	}
+	if !flags.Changed("cpu-max") && archiveLimits.CPUMax > 0 {
+		limits.CPUMax = archiveLimits.CPUMax
+	}
+
+	if err := limits.Validate(); err != nil {
+		return sandbox.Limits{}, false, fmt.Errorf("invalid limits in the archive: %w", err)
+	}
+
+	return limits, false, nil
+}
+
+// removeSandbox removes the sandbox of the command once it is done with it
+func removeSandbox() {
+	if err := sandbox.RemoveRootfs(); err != nil {
+		logger.Error(err)
+	}
+}
+
+// instructorVerifyKey returns the public key archives have to be signed with:
+// the --verify-key file, or the key qo was built with. nil means archives are
+// not verified, which needs --allow-unsigned.
+func instructorVerifyKey() (ed25519.PublicKey, error) {
+	if verifyKeyPath != "" {
+		return keys.ReadVerifyKey(verifyKeyPath)
+	}
+
+	if instructorKey != "" {
+		return keys.ParseVerifyKey(instructorKey)
+	}
+
+	if !allowUnsigned {
+		return nil, fmt.Errorf("no instructor public key to check the archive with, give it with --verify-key, or open the archive unchecked with --allow-unsigned")
+	}
+
+	logger.Warn("The archive is not checked against an instructor public key, it could have been built by anyone.")
+
+	return nil, nil
+}
+
 func init() {
 	rootCmd.AddCommand(startCmd)
 
 	// Flags
 	startCmd.Flags().StringVarP(&idStr, "id", "i", "0", "Student ID (required)")
 	startCmd.Flags().StringVarP(&archivePath, "archive", "a", "", "Path to the encrypted archive file (required)")
-	startCmd.Flags().StringVarP(&passwordStart, "password", "p", "", "Password used for encrypt the archive (required)")
+	startCmd.Flags().StringVarP(&passwordStart, "password", "p", "", "Password used for encrypt the archive (required, unless --identity is given)")
+	startCmd.Flags().StringVar(&identityPath, "identity", "", "Your private key, for archives built for each student")
 	startCmd.Flags().StringVarP(&utKeyStart, "key", "k", "", "Starter key used for decryption (required)")
 	startCmd.Flags().DurationVarP(&testDuration, "duration", "d", 0, "Total duration of the test (e.g., 90m, 1h30m) (required)")
+	startCmd.Flags().DurationSliceVarP(&warnAt, "warn-at", "w", []time.Duration{10 * time.Minute, time.Minute}, "Remaining times at which the student is warned (e.g., 10m,1m)")
+	startCmd.Flags().DurationVarP(&checkTimeout, "check-timeout", "t", 30*time.Second, "Maximum run time of each level's check script")
+	startCmd.Flags().StringVar(&verifyKeyPath, "verify-key", "", "Instructor public key the archive must be signed with")
+	startCmd.Flags().BoolVar(&allowUnsigned, "allow-unsigned", false, "Open archives without checking who built them, when qo has no instructor public key")
+	startCmd.Flags().BoolVar(&allowSharedUser, "allow-shared-user", false, "Start without root or subordinate ids, where the student is the user running qo and can read the check scripts")
 	startCmd.Flags().StringVarP(&outputLogDir, "output", "o", "eval-results", "Output directory for logs and PDF reports")
+	startCmd.Flags().Int64Var(&pidsMax, "pids-max", 1024, "Maximum number of processes in the sandbox, 0 for no limit, replaces the limit of the challenge")
+	startCmd.Flags().StringVar(&memoryMax, "memory-max", "", "Maximum memory of the sandbox, like 512M or 2G, 0 for no limit, replaces the limit of the challenge")
+	startCmd.Flags().Float64Var(&cpuMax, "cpu-max", 0, "Number of CPUs the sandbox can keep busy, like 0.5 or 2, at least 0.01, 0 for no limit, replaces the limit of the challenge")
 
 	startCmd.MarkFlagRequired("id")
 	startCmd.MarkFlagRequired("archive")
-	startCmd.MarkFlagRequired("password")
+	startCmd.MarkFlagsOneRequired("password", "identity")
+	startCmd.MarkFlagsMutuallyExclusive("password", "identity")
 	startCmd.MarkFlagRequired("key")
 	startCmd.MarkFlagRequired("duration")
 
 	rootCmd.SilenceUsage = true
 	rootCmd.SilenceErrors = true
-
-	// This is done to enable user to input id like `093` and parse it as decimal not octal
-	var err error
-	id, err = strconv.ParseUint(idStr, 10, 16)
-	if err != nil {
-		logger.Error(err)
-		os.Exit(1)
-	}
 }
@@ -0,0 +1,320 @@
+package cmd
+
+// verify.go - Instructor Command
+//
+// This command dry-runs a challenge against its own check scripts before it is given to students.
+//
+// Workflow:
+// 1. Sets up the sandbox from an archive (whatever its unlock time) or from a challenge folder.
+// 2. Runs each level's check.sh in the untouched sandbox, it is expected to fail.
+// 3. Sets up a fresh sandbox and, level after level, runs the reference solution as the student then the check.sh, which is expected to pass.
+// 4. Reports the levels whose check script does not tell solved and unsolved levels apart,
+//    with the end of the output of the scripts that did not behave.
+//
+// Solutions are scripts named <level>.sh in the solutions directory. They run
+// inside the sandbox as the student, from /tmp where the challenge folder is.
+//
+// Flags:
+// -a, --archive       Path to the encrypted archive file (required, unless --folder is given)
+// -p, --password      Password used to encrypt the archive (required with --archive, unless --identity is given)
+//     --identity      Student private key, for archives built for each student
+// -k, --key           Starter key, for split-key archives (optional)
+// -f, --folder        Path to the challenge folder (required, unless --archive is given)
+// -s, --solutions     Directory of the reference solution scripts (required)
+// -t, --check-timeout Maximum run time of each check and solution script (optional, default: 30s)
+//
+// Usage Example:
+// sudo qo verify -f ./challenges -s ./solutions
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ahmedYasserM/qo/pkg/archive"
+	"github.com/ahmedYasserM/qo/pkg/grader"
+	"github.com/ahmedYasserM/qo/pkg/keys"
+	"github.com/ahmedYasserM/qo/pkg/logger"
+	"github.com/ahmedYasserM/qo/pkg/manifest"
+	"github.com/ahmedYasserM/qo/pkg/sandbox"
+	"github.com/spf13/cobra"
+)
+
+var (
+	verifyArchivePath  string
+	verifyPassword     string
+	verifyIdentityPath string
+	verifyStarterKey   string
+	verifyFolderPath   string
+	solutionsDir       string
+	verifyTimeout      time.Duration
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check that each level's check.sh fails without the reference solution and passes with it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Without root, the sandbox needs unprivileged user namespaces. The
+		// solutions are the instructor's, they may share the user of qo.
+		if err := sandbox.CheckRootless(true); err != nil {
+			return err
+		}
+
+		if verifyArchivePath != "" && verifyPassword == "" && verifyIdentityPath == "" {
+			return errors.New("--password or --identity is required to open the archive")
+		}
+
+		logger.Info("Running the check scripts without the solutions...")
+
+		defer removeSandbox()
+
+		challenge, checkCfg, err := prepareVerifySandbox()
+		if err != nil {
+			return err
+		}
+
+		levels, err := grader.Levels(challenge)
+		if err != nil {
+			return err
+		}
+
+		// Solutions are applied in the order levels are graded
+		challengeManifest, err := manifest.Load(filepath.Join(sandbox.ChecksDir, challenge))
+		if err != nil {
+			return err
+		}
+		levels = challengeManifest.Order(levels)
+
+		levelCfg := func(level string) sandbox.CheckConfig {
+			cfg := checkCfg
+			cfg.Timeout = challengeManifest.CheckTimeout(level, verifyTimeout)
+			return cfg
+		}
+
+		withoutSolution := make(map[string]sandbox.CheckResult)
+		for _, level := range levels {
+			result, err := sandbox.RunCheck(grader.CheckScript(challenge, level), levelCfg(level))
+			if err != nil {
+				return err
+			}
+
+			withoutSolution[level] = result
+		}
+
+		logger.Info("Running the check scripts after the solutions...")
+
+		if _, _, err := prepareVerifySandbox(); err != nil {
+			return err
+		}
+
+		broken := 0
+		for _, level := range levels {
+			ok, err := verifyLevel(challenge, level, withoutSolution[level], levelCfg(level))
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				broken++
+			}
+		}
+
+		if broken > 0 {
+			return fmt.Errorf("%d/%d levels can not be graded correctly", broken, len(levels))
+		}
+
+		logger.Success(fmt.Sprintf("All %d levels are graded correctly.", len(levels)))
+
+		return nil
+	},
+}
+
+// prepareVerifySandbox extracts a fresh rootfs and installs the challenge in
+// it. It returns the name of the challenge and how its checks are isolated
+// and limited, like they would be after a session. The limits are only
+// enforced when the machine allows it, verify runs no student session.
+func prepareVerifySandbox() (string, sandbox.CheckConfig, error) {
+	if err := sandbox.ExtractRootfs(); err != nil {
+		return "", sandbox.CheckConfig{}, err
+	}
+
+	if verifyFolderPath != "" {
+		if err := archive.IsValidFolderStructure(verifyFolderPath); err != nil {
+			return "", sandbox.CheckConfig{}, err
+		}
+
+		challenge, err := archive.ExtractFolder(verifyFolderPath)
+		if err != nil {
+			return "", sandbox.CheckConfig{}, err
+		}
+
+		cfg, err := folderCheckConfig(challenge)
+
+		return challenge, cfg, err
+	}
+
+	opts := archive.DecryptOptions{
+		Password:   verifyPassword,
+		StarterKey: verifyStarterKey,
+	}
+
+	if verifyIdentityPath != "" {
+		identity, err := keys.ReadIdentity(verifyIdentityPath)
+		if err != nil {
+			return "", sandbox.CheckConfig{}, err
+		}
+		opts.Identity = identity
+	}
+
+	challenge, metadata, err := archive.ExtractArchive(verifyArchivePath, opts)
+	if err != nil {
+		return "", sandbox.CheckConfig{}, err
+	}
+
+	cfg := sandbox.CheckConfig{
+		Timeout:          verifyTimeout,
+		Network:          metadata.Network,
+		Namespaces:       metadata.Namespaces,
+		BestEffortLimits: true,
+	}
+	if metadata.Limits != nil {
+		cfg.Limits = *metadata.Limits
+	}
+
+	return challenge, cfg, nil
+}
+
+// folderCheckConfig isolates and limits the checks of a challenge folder like
+// `qo build` would its sandbox, from the manifest
+func folderCheckConfig(challenge string) (sandbox.CheckConfig, error) {
+	cfg := sandbox.CheckConfig{Timeout: verifyTimeout, BestEffortLimits: true}
+
+	challengeManifest, err := manifest.Load(filepath.Join(sandbox.ChecksDir, challenge))
+	if err != nil || challengeManifest == nil {
+		return cfg, err
+	}
+
+	if cfg.Network, err = sandbox.ParseNetwork(string(challengeManifest.Network)); err != nil {
+		return cfg, err
+	}
+
+	if len(challengeManifest.Namespaces) > 0 {
+		if cfg.Namespaces, err = sandbox.ParseNamespaces(challengeManifest.Namespaces); err != nil {
+			return cfg, err
+		}
+	}
+
+	if cfg.Limits, err = challengeManifest.Limits.Sandbox(); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// verifyLevel applies the solution of level to the sandbox, runs its check
+// script and reports whether the level is graded correctly. without is the
+// result of the check script before any solution was applied. The solution
+// runs isolated like the check, within verifyTimeout.
+func verifyLevel(challenge, level string, without sandbox.CheckResult, cfg sandbox.CheckConfig) (bool, error) {
+	ok := true
+	if without.Passed() {
+		logger.Warn(fmt.Sprintf("%s: check.sh passes without the solution.", level))
+		showOutput(without)
+		ok = false
+	}
+
+	solution := filepath.Join(solutionsDir, level+".sh")
+	if _, err := os.Stat(solution); err != nil {
+		logger.Warn(fmt.Sprintf("%s: no solution found at %s.", level, solution))
+		return false, nil
+	}
+
+	solutionCfg := cfg
+	solutionCfg.Timeout = verifyTimeout
+
+	result, err := sandbox.RunCheck(solution, solutionCfg)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case result.TimedOut:
+		logger.Warn(fmt.Sprintf("%s: the solution did not finish within %s.", level, verifyTimeout))
+		showOutput(result)
+	case result.ExitCode != 0:
+		logger.Warn(fmt.Sprintf("%s: the solution exited with status %d.", level, result.ExitCode))
+		showOutput(result)
+	}
+
+	result, err = sandbox.RunCheck(grader.CheckScript(challenge, level), cfg)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case result.TimedOut:
+		logger.Warn(fmt.Sprintf("%s: check.sh did not finish within %s after the solution.", level, cfg.Timeout))
+		showOutput(result)
+		ok = false
+	case result.ExitCode != 0:
+		logger.Warn(fmt.Sprintf("%s: check.sh exited with status %d after the solution.", level, result.ExitCode))
+		showOutput(result)
+		ok = false
+	}
+
+	if ok {
+		logger.Success(fmt.Sprintf("%s: check.sh fails without the solution and passes with it.", level))
+	}
+
+	return ok, nil
+}
+
+// outputLines is how many of the last lines of each output stream are shown
+const outputLines = 10
+
+// showOutput prints the end of the output of a script that did not behave,
+// so the instructor sees why
+func showOutput(result sandbox.CheckResult) {
+	streams := []struct {
+		name string
+		data []byte
+	}{{"stdout", result.Stdout}, {"stderr", result.Stderr}}
+
+	for _, stream := range streams {
+		text := strings.TrimRight(string(stream.data), "\n")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		lines := strings.Split(text, "\n")
+		if len(lines) > outputLines {
+			fmt.Printf("    %s | ... %d lines before\n", stream.name, len(lines)-outputLines)
+			lines = lines[len(lines)-outputLines:]
+		}
+
+		for _, line := range lines {
+			fmt.Printf("    %s | %s\n", stream.name, line)
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	// Flags
+	verifyCmd.Flags().StringVarP(&verifyArchivePath, "archive", "a", "", "Path to the encrypted archive file (required, unless --folder is given)")
+	verifyCmd.Flags().StringVarP(&verifyPassword, "password", "p", "", "Password used to encrypt the archive")
+	verifyCmd.Flags().StringVar(&verifyIdentityPath, "identity", "", "Student private key, for archives built for each student")
+	verifyCmd.Flags().StringVarP(&verifyStarterKey, "key", "k", "", "Starter key, for split-key archives")
+	verifyCmd.Flags().StringVarP(&verifyFolderPath, "folder", "f", "", "Path to the challenge folder (required, unless --archive is given)")
+	verifyCmd.Flags().StringVarP(&solutionsDir, "solutions", "s", "", "Directory of the reference solutions, one <level>.sh script per level (required)")
+	verifyCmd.Flags().DurationVarP(&verifyTimeout, "check-timeout", "t", 30*time.Second, "Maximum run time of each check and solution script")
+
+	verifyCmd.MarkFlagRequired("solutions")
+	verifyCmd.MarkFlagsOneRequired("archive", "folder")
+	verifyCmd.MarkFlagsMutuallyExclusive("archive", "folder")
+	verifyCmd.MarkFlagsMutuallyExclusive("password", "identity")
+}
@@ -10,8 +10,14 @@ import (
 
 func main() {
 
+	// Rootless sandbox processes wait until qo mapped their user namespace
+	if err := sandbox.WaitIDMap(); err != nil {
+		logger.Error(err)
+		os.Exit(1)
+	}
+
 	if len(os.Args) == 1 && os.Args[0] == "init" {
-		if err := sandbox.StartSandBox(); err != nil {
+		if err := sandbox.InitSandBox(); err != nil {
 			logger.Error(err)
 			os.Exit(1)
 		} else {
@@ -19,6 +25,27 @@ func main() {
 		}
 	}
 
+	// Started by sandbox.CheckRootless, creating the namespaces was the test
+	if len(os.Args) == 1 && os.Args[0] == "probe" {
+		os.Exit(0)
+	}
+
+	// Started by sandbox.RemoveRootfs to remove the files of a rootless sandbox
+	if len(os.Args) == 1 && os.Args[0] == "clean" {
+		if err := sandbox.CleanSandBox(); err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(os.Args) == 2 && os.Args[0] == "check" {
+		if err := sandbox.CheckSandBox(os.Args[1]); err != nil {
+			logger.Error(err)
+			os.Exit(1)
+		}
+	}
+
 	if err := cmd.Execute(); err != nil {
 		logger.Error(err)
 		os.Exit(1)
@@ -4,29 +4,30 @@ import (
 	"archive/tar"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/ahmedYasserM/qo/pkg/clock"
 	"github.com/ahmedYasserM/qo/pkg/logger"
+	"github.com/ahmedYasserM/qo/pkg/manifest"
 	"github.com/ahmedYasserM/qo/pkg/sandbox"
+	"golang.org/x/sys/unix"
 )
 
-func newStreamDecryptReader(r io.Reader, key []byte, nonce []byte) (io.Reader, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-
-	stream := cipher.NewCTR(block, nonce)
-	reader := cipher.StreamReader{
-		S: stream,
-		R: r,
-	}
-
-	return reader, nil
-}
+var (
+	ErrWrongStarterKey = errors.New("wrong starter key")
+	ErrExamClosed      = errors.New("the exam window is closed")
+	ErrLocked          = errors.New("the archive can not be decrypted before the unlock time")
+)
 
 // Decrypt data with AES-GCM
 func decrypt(data, key []byte) ([]byte, error) {
@@ -47,101 +48,191 @@ func decrypt(data, key []byte) ([]byte, error) {
 }
 
 // Check if we reach the unlock time or not
-func checkUnlockTime(ut string) (bool, error) {
-	layout := "2006-01-02 15:04"
-
-	parsedUt, err := time.ParseInLocation(layout, ut, time.Local)
+func checkUnlockTime(ut []byte, now time.Time) (bool, error) {
+	parsedUt, err := decodeUnlockTime(ut)
 	if err != nil {
 		return false, err
 	}
 
-	now := time.Now()
-
 	return now.After(parsedUt) || now.Equal(parsedUt), nil
 }
 
-func DecryptTarArchive(encryptedFile, password, utKey string) error {
-	file, err := os.Open(encryptedFile)
-	if err != nil {
-		return err
+// DecryptOptions holds what is needed to open an archive
+type DecryptOptions struct {
+	Password   string
+	StarterKey string
+
+	// VerifyKey is the instructor's public key. When set, unsigned archives and
+	// archives signed with another key are rejected before anything is decrypted.
+	VerifyKey ed25519.PublicKey
+
+	// Identity is the student's private key, instead of the password, for archives built for recipients
+	Identity *ecdh.PrivateKey
+}
+
+// contentKey returns the key the archive content is decrypted with
+func contentKey(header *Header, opts DecryptOptions) ([]byte, error) {
+	if header.Flags&FlagRecipients == 0 {
+		if opts.Password == "" {
+			return nil, errors.New("the archive is encrypted with a password")
+		}
+
+		return header.KDF.DeriveKey(opts.Password, header.Salt)
 	}
-	defer file.Close()
 
-	// Read salt (16 bytes)
-	salt := make([]byte, 16)
-	if _, err := io.ReadFull(file, salt); err != nil {
-		return err
+	if opts.Identity == nil {
+		return nil, errors.New("the archive is encrypted for individual students, open it with your identity key")
 	}
 
-	// Derive key
-	key := DeriveKey(password, salt)
+	return unwrapKey(header.Recipients, opts.Identity)
+}
 
-	// Read nonce
-	nonce := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(file, nonce); err != nil {
-		return err
+// archiveClock returns the time source the unlock time has to be checked against
+func archiveClock(metadata Metadata) (clock.Source, error) {
+	if metadata.TimePolicy == "" {
+		return clock.Local{}, nil
 	}
 
-	// Create a stream decrypt reader from the encrypted file
-	decryptReader, err := newStreamDecryptReader(file, key, nonce)
+	return clock.New(metadata.TimeServer, metadata.TimePolicy)
+}
+
+// DecryptTarArchive extracts the challenge folder into the sandbox rootfs once
+// the unlock time is reached. Check scripts are extracted to sandbox.ChecksDir
+// instead, out of the student's reach. It returns the name of the challenge
+// folder and the public metadata of the archive.
+func DecryptTarArchive(encryptedFile string, opts DecryptOptions) (string, Metadata, error) {
+	opened, err := openArchive(encryptedFile, opts)
 	if err != nil {
-		return err
+		return "", Metadata{}, err
 	}
 
-	// Open the decrypted tar archive in memory
-	tr := tar.NewReader(decryptReader)
-	var ut []byte
+	archiveHeader := opened.header
 
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break // End of archive
-		}
-		if err != nil {
-			return err
-		}
+	if opts.VerifyKey != nil {
+		logger.Info("The archive signature is valid.")
+	} else if archiveHeader.Flags&FlagSigned != 0 {
+		logger.Warn("The archive is signed, but no instructor public key was given to verify it.")
+	}
 
-		if header.Name == ".ut" {
-			encryptedUt, err := io.ReadAll(tr)
-			if err != nil {
-				return err
-			}
+	if archiveHeader.Metadata.Course != "" {
+		logger.Info(fmt.Sprintf("Course: %s", archiveHeader.Metadata.Course))
+	}
 
-			// Decrypt the unlock time
-			if ut, err = decrypt(encryptedUt, DeriveKey(utKey, salt)); err != nil {
-				return err
-			}
+	// Open the decrypted tar archive in memory
+	tr, err := opened.entries()
+	if err != nil {
+		return "", Metadata{}, err
+	}
 
-			break
-		}
+	ut, lt, _, err := opened.readTimes(tr)
+	if err != nil {
+		return "", Metadata{}, err
 	}
 
+	timeSource, err := archiveClock(archiveHeader.Metadata)
+	if err != nil {
+		return "", Metadata{}, err
+	}
+
+	now, err := timeSource.Now()
+	if err != nil {
+		return "", Metadata{}, fmt.Errorf("could not get a trusted time from %s: %w", timeSource, err)
+	}
+
+	logger.Info(fmt.Sprintf("Checking the unlock time against %s.", timeSource))
+
 	// if the current time >= the ulock time then canProceed wth the decryption
-	canProceed, err := checkUnlockTime(string(ut))
+	canProceed, err := checkUnlockTime(ut, now)
 	if err != nil {
-		return err
+		return "", Metadata{}, err
 	}
 
 	if !canProceed {
-		logger.Warn("Can not decrypt the archive before the unlock time.")
-		os.Exit(0)
+		unlockTime, _ := decodeUnlockTime(ut)
+		return "", Metadata{}, fmt.Errorf("%w, it unlocks at %s", ErrLocked, unlockTime.Local().Format("2006-01-02 15:04 MST"))
+	}
+
+	// The lock time is reached the same way the unlock time is
+	if lt != nil {
+		closed, err := checkUnlockTime(lt, now)
+		if err != nil {
+			return "", Metadata{}, err
+		}
+
+		if closed {
+			lockTime, _ := decodeUnlockTime(lt)
+			return "", Metadata{}, fmt.Errorf("%w since %s", ErrExamClosed, lockTime.Local().Format("2006-01-02 15:04 MST"))
+		}
 	}
 
 	logger.Info("Unlock time reached. Extracting archive...")
 
-	// Start decryption again from the beginning, extract all files except .ut
+	// Start decryption again from the beginning
+	tr, err = opened.entries()
+	if err != nil {
+		return "", Metadata{}, err
+	}
+
+	challenge, err := extractChallenge(tr)
+
+	return challenge, archiveHeader.Metadata, err
+}
 
-	_, err = file.Seek(16+aes.BlockSize, io.SeekStart)
+// ExtractArchive extracts the challenge folder like DecryptTarArchive, whatever
+// the unlock and lock times. It is meant for instructors testing their own archives.
+func ExtractArchive(encryptedFile string, opts DecryptOptions) (string, Metadata, error) {
+	opened, err := openArchive(encryptedFile, opts)
 	if err != nil {
-		return err
+		return "", Metadata{}, err
 	}
 
-	decryptReader, err = newStreamDecryptReader(file, key, nonce)
+	tr, err := opened.entries()
 	if err != nil {
-		return err
+		return "", Metadata{}, err
 	}
 
-	tr = tar.NewReader(decryptReader)
+	challenge, err := extractChallenge(tr)
+
+	return challenge, opened.header.Metadata, err
+}
+
+// ExtractFolder installs a challenge folder in the sandbox the way an archive
+// of it would be extracted, check scripts included.
+func ExtractFolder(folder string) (string, error) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := writeFolder(tw, filepath.Clean(folder))
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	challenge, err := extractChallenge(tar.NewReader(pr))
+	pr.CloseWithError(err)
+
+	return challenge, err
+}
+
+// extractChallenge extracts all files of tr except .ut and .lt into the
+// sandbox rootfs, and check scripts into sandbox.ChecksDir. It returns the name
+// of the challenge folder. qo may run as root: no entry may leave the
+// challenge folder, by its name or through a symbolic link.
+func extractChallenge(tr *tar.Reader) (string, error) {
+	challenge := ""
+
+	// The challenge folder in the sandbox and next to the check scripts
+	var sandboxDir, checksDir *os.Root
+	defer func() {
+		if sandboxDir != nil {
+			sandboxDir.Close()
+		}
+		if checksDir != nil {
+			checksDir.Close()
+		}
+	}()
 
 	for {
 		header, err := tr.Next()
@@ -150,45 +241,151 @@ func DecryptTarArchive(encryptedFile, password, utKey string) error {
 		}
 
 		if err != nil {
-			return err
+			return "", err
 		}
 
-		if header.Name == ".ut" {
+		if header.Name == ".ut" || header.Name == ".lt" {
 			continue
 		}
 
-		dest := filepath.Join(sandbox.Rootfs, "tmp", header.Name)
+		name, err := entryPath(header.Name)
+		if err != nil {
+			return "", err
+		}
+
+		// Every entry lives under the challenge folder, so the first path element is its name
+		parts := strings.Split(name, "/")
+		if challenge == "" {
+			challenge = parts[0]
+
+			if sandboxDir, err = createRoot(filepath.Join(sandbox.Rootfs, "tmp", challenge)); err != nil {
+				return "", err
+			}
+			if checksDir, err = createRoot(filepath.Join(sandbox.ChecksDir, challenge)); err != nil {
+				return "", err
+			}
+		}
+
+		if parts[0] != challenge {
+			return "", fmt.Errorf("the archive entry %q is outside of the challenge folder %s", header.Name, challenge)
+		}
+
+		if len(parts) == 1 {
+			if header.Typeflag != tar.TypeDir {
+				return "", fmt.Errorf("the challenge %s is not a folder", challenge)
+			}
+			continue
+		}
+
+		rel := path.Join(parts[1:]...)
+		perm := os.FileMode(header.Mode).Perm()
+		dest := sandboxDir
+
+		// <challenge>/<level>/check.sh and <challenge>/challenge.yaml are for the grader, keep them outside the sandbox
+		if len(parts) == 3 && parts[2] == "check.sh" || len(parts) == 2 && parts[1] == manifest.FileName {
+			if header.Typeflag != tar.TypeReg {
+				return "", fmt.Errorf("%s is not a regular file", header.Name)
+			}
+			dest = checksDir
+		}
+
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(dest, os.FileMode(header.Mode)); err != nil {
-				return err
+			if err := mkdirAll(dest, rel, perm); err != nil {
+				return "", err
 			}
 		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
-				return err
-			}
-
-			toFile, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
-			defer toFile.Close()
-			if err != nil {
-				return err
+			if err := mkdirAll(dest, path.Dir(rel), 0755); err != nil {
+				return "", err
 			}
 
-			if _, err = io.Copy(toFile, tr); err != nil {
-				toFile.Close()
-				return err
+			if err := extractFile(dest, rel, perm, tr); err != nil {
+				return "", err
 			}
 		case tar.TypeSymlink:
-			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
-				return err
+			target := path.Join(path.Dir(name), header.Linkname)
+			if path.IsAbs(header.Linkname) || target != challenge && !strings.HasPrefix(target, challenge+"/") {
+				return "", fmt.Errorf("the symbolic link %s points outside of the challenge folder: %s", header.Name, header.Linkname)
 			}
 
-			if err := os.Symlink(header.Linkname, dest); err != nil {
-				return err
+			if err := mkdirAll(dest, path.Dir(rel), 0755); err != nil {
+				return "", err
 			}
 
+			if err := symlink(dest, header.Linkname, rel); err != nil {
+				return "", err
+			}
 		}
 	}
 
+	return challenge, nil
+}
+
+// entryPath cleans the name of an archive entry, which has to stay in the
+// folder the archive is extracted to
+func entryPath(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("the archive entry %q is outside of the challenge folder", name)
+	}
+
+	return clean, nil
+}
+
+// createRoot creates the folder dir and opens it as a root: names are then
+// resolved inside it, the symbolic links of the archive can not lead out of it
+func createRoot(dir string) (*os.Root, error) {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return os.OpenRoot(dir)
+}
+
+// mkdirAll creates the folder name of root along with its parents, like os.MkdirAll
+func mkdirAll(root *os.Root, name string, perm os.FileMode) error {
+	if name == "." {
+		return nil
+	}
+
+	if err := mkdirAll(root, path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	if err := root.Mkdir(name, perm); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	return nil
+}
+
+// extractFile writes the content of the current entry of tr to the new file
+// name of root. An entry of the archive is never overwritten.
+func extractFile(root *os.Root, name string, perm os.FileMode, tr *tar.Reader) error {
+	toFile, err := root.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(toFile, tr)
+	if closeErr := toFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// symlink creates the symbolic link name of root, pointing to target
+func symlink(root *os.Root, target, name string) error {
+	dir, err := root.Open(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if err := unix.Symlinkat(target, int(dir.Fd()), path.Base(name)); err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: name, Err: err}
+	}
+
 	return nil
 }
@@ -0,0 +1,155 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ahmedYasserM/qo/pkg/sandbox"
+)
+
+// entry is a file, folder or symbolic link of a test archive
+type entry struct {
+	name     string
+	typeflag byte
+	content  string // the target of symbolic links
+}
+
+// tarEntries writes entries to an in-memory tar archive
+func tarEntries(t *testing.T, entries []entry) *tar.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644}
+		switch e.typeflag {
+		case tar.TypeDir:
+			header.Mode = 0755
+		case tar.TypeReg:
+			header.Size = int64(len(e.content))
+		case tar.TypeSymlink:
+			header.Linkname = e.content
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return tar.NewReader(&buf)
+}
+
+// useTempSandbox points the sandbox folders to a temporary directory, the
+// host is the directory around them
+func useTempSandbox(t *testing.T) string {
+	t.Helper()
+
+	rootfs, checksDir := sandbox.Rootfs, sandbox.ChecksDir
+	t.Cleanup(func() { sandbox.Rootfs, sandbox.ChecksDir = rootfs, checksDir })
+
+	host := t.TempDir()
+	sandbox.Rootfs = filepath.Join(host, "rootfs")
+	sandbox.ChecksDir = filepath.Join(host, "checks")
+	for _, dir := range []string{filepath.Join(sandbox.Rootfs, "tmp"), sandbox.ChecksDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return host
+}
+
+func TestExtractChallenge(t *testing.T) {
+	dir := func(name string) entry { return entry{name, tar.TypeDir, ""} }
+	file := func(name string) entry { return entry{name, tar.TypeReg, "escaped"} }
+	link := func(name, target string) entry { return entry{name, tar.TypeSymlink, target} }
+
+	tests := []struct {
+		name    string
+		entries []entry
+		wantErr bool
+	}{
+		{"challenge", []entry{
+			dir("ch"), file("ch/challenge.yaml"), dir("ch/a"), file("ch/a/description.md"), file("ch/a/check.sh"),
+			dir("ch/a/data"), link("ch/a/link", "data"), file("ch/a/link/file"), link("ch/up", "a/../a"),
+		}, false},
+		{"parent of the folder", []entry{dir("ch"), file("ch/../../escaped")}, true},
+		{"absolute name", []entry{dir("ch"), file("/escaped")}, true},
+		{"other folder", []entry{dir("ch"), file("ch/../other/escaped")}, true},
+		{"challenge file", []entry{file("ch")}, true},
+		{"absolute link", []entry{dir("ch"), link("ch/host", "/"), file("ch/host/escaped")}, true},
+		{"link out of the folder", []entry{dir("ch"), link("ch/host", "../../.."), file("ch/host/escaped")}, true},
+		{"file over a link", []entry{dir("ch"), link("ch/a", "b"), file("ch/a")}, true},
+		{"check script link", []entry{dir("ch"), dir("ch/a"), link("ch/a/check.sh", "description.md")}, true},
+		{"manifest link", []entry{dir("ch"), link("ch/challenge.yaml", "a")}, true},
+
+		// Each link stays in the folder by its name, together they lead out of it
+		{"link chain out of the folder", []entry{
+			dir("ch"), dir("ch/f"), dir("ch/c"), dir("ch/c/d"), dir("ch/c/d/e"),
+			link("ch/c/d/e/a", "../../../f"), link("ch/y", "c/d/e/a/../.."), file("ch/y/escaped"),
+		}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host := useTempSandbox(t)
+
+			challenge, err := extractChallenge(tarEntries(t, test.entries))
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("the archive was extracted, want an error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if challenge != "ch" {
+				t.Errorf("the challenge is %q, want ch", challenge)
+			}
+
+			// Nothing may be written next to the challenge folder
+			for _, escaped := range []string{"escaped", "rootfs/escaped", "rootfs/tmp/escaped", "rootfs/tmp/other", "checks/escaped"} {
+				if _, err := os.Lstat(filepath.Join(host, escaped)); err == nil {
+					t.Errorf("%s was written outside of the challenge folder", escaped)
+				}
+			}
+		})
+	}
+}
+
+// TestExtractChallengeFolders checks where the check scripts and the manifest
+// are extracted
+func TestExtractChallengeFolders(t *testing.T) {
+	host := useTempSandbox(t)
+
+	entries := []entry{
+		{"ch", tar.TypeDir, ""},
+		{"ch/challenge.yaml", tar.TypeReg, "title: ch\n"},
+		{"ch/a", tar.TypeDir, ""},
+		{"ch/a/check.sh", tar.TypeReg, "#!/bin/bash\n"},
+		{"ch/a/description.md", tar.TypeReg, "# a\n"},
+	}
+	if _, err := extractChallenge(tarEntries(t, entries)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"checks/ch/challenge.yaml", "checks/ch/a/check.sh", "rootfs/tmp/ch/a/description.md"} {
+		if _, err := os.Stat(filepath.Join(host, name)); err != nil {
+			t.Errorf("%s was not extracted: %v", name, err)
+		}
+	}
+	for _, name := range []string{"rootfs/tmp/ch/challenge.yaml", "rootfs/tmp/ch/a/check.sh"} {
+		if _, err := os.Stat(filepath.Join(host, name)); err == nil {
+			t.Errorf("%s is visible from the sandbox", name)
+		}
+	}
+}
@@ -4,35 +4,19 @@ import (
 	"archive/tar"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"time"
 )
 
-func newStreamEncryptWriter(w io.Writer, key []byte) (io.Writer, []byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, nil, err
-	}
-	nonce := make([]byte, aes.BlockSize)
-	if _, err := rand.Read(nonce); err != nil {
-		return nil, nil, err
-	}
-	salt := make([]byte, 16)
-	if _, err := rand.Read(salt); err != nil {
-		return nil, nil, err
-	}
-
-	stream := cipher.NewCTR(block, nonce)
-	writer := cipher.StreamWriter{
-		S: stream,
-		W: w,
-	}
-	return writer, nonce, nil
-}
-
 // Encrypt data with AES-GCM
 func encrypt(data, key []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
@@ -68,37 +52,133 @@ func addFileToArchive(tw *tar.Writer, filename string, fileContent []byte) error
 	return err
 }
 
-func CreateEncryptedTarArchive(sourceDir, outputFile, unlockDate, password, key string) error {
+// newContentKey returns the key the archive content is encrypted with. For
+// recipients it is random and wrapped in the header, before the header is encoded.
+func newContentKey(header *Header, opts EncryptOptions) ([]byte, error) {
+	if len(opts.Recipients) == 0 {
+		return header.KDF.DeriveKey(opts.Password, header.Salt)
+	}
+
+	contentKey := make([]byte, contentKeySize)
+	if _, err := rand.Read(contentKey); err != nil {
+		return nil, err
+	}
+
+	header.Flags |= FlagRecipients
+	for _, recipient := range opts.Recipients {
+		stanza, err := wrapKey(contentKey, recipient)
+		if err != nil {
+			return nil, err
+		}
+
+		header.Recipients = append(header.Recipients, stanza)
+	}
+
+	return contentKey, nil
+}
+
+// EncryptOptions describes how a challenge folder is packaged
+type EncryptOptions struct {
+	UnlockTime time.Time
+
+	// LockTime closes the exam window, sessions can not be started after it. Zero keeps the archive open forever.
+	LockTime time.Time
+
+	Password   string
+	StarterKey string
+	Metadata   Metadata
+
+	// KDF derives the keys from the password and the starter key, Argon2idDefaults when unset
+	KDF KDFParams
+
+	// SigningKey signs the archive when set
+	SigningKey ed25519.PrivateKey
+
+	// Recipients are the public keys of the students the archive is built
+	// for. They replace the password: each student opens it with their own key.
+	Recipients []*ecdh.PublicKey
+
+	// SplitKey makes the starter key part of the content key, see split.go
+	SplitKey bool
+}
+
+func CreateEncryptedTarArchive(sourceDir, outputFile string, opts EncryptOptions) error {
+	if !opts.LockTime.IsZero() && !opts.LockTime.After(opts.UnlockTime) {
+		return fmt.Errorf("the lock time %s is not after the unlock time %s", opts.LockTime.UTC().Format(time.RFC3339), opts.UnlockTime.UTC().Format(time.RFC3339))
+	}
+
+	if len(opts.Recipients) > 0 && opts.Password != "" {
+		return errors.New("an archive is encrypted either with a password or for recipients, not both")
+	}
+
 	archiveFile, err := os.Create(outputFile)
 	if err != nil {
 		return err
 	}
 	defer archiveFile.Close()
 
-	salt := make([]byte, 16)
-	rand.Read(salt)
+	kdf := opts.KDF
+	if kdf.Algorithm == 0 {
+		kdf = Argon2idDefaults
+	}
+
+	if err := kdf.validate(); err != nil {
+		return err
+	}
+
+	header, err := newHeader(kdf, opts.Metadata)
+	if err != nil {
+		return err
+	}
+
+	// Everything written before the signature is signed
+	out := io.Writer(archiveFile)
+	digest := sha512.New()
+	if opts.SigningKey != nil {
+		header.Flags |= FlagSigned
+		out = io.MultiWriter(archiveFile, digest)
+	}
+
+	contentKey, err := newContentKey(header, opts)
+	if err != nil {
+		return err
+	}
 
-	// Create encryptio writer
-	encWriter, nonce, err := newStreamEncryptWriter(archiveFile, DeriveKey(password, salt))
+	if opts.SplitKey {
+		header.Flags |= FlagSplitKey
+	}
+
+	// Write the header to the start of archiveFile for decryption later
+	rawHeader, err := header.encode()
 	if err != nil {
 		return err
 	}
 
-	// Write to the start of archiveFile for decryption later
-	if _, err = archiveFile.Write(salt); err != nil {
+	if _, err = out.Write(rawHeader); err != nil {
 		return err
 	}
 
-	// Write nonce after salt
-	if _, err = archiveFile.Write(nonce); err != nil {
+	utKey, err := header.KDF.DeriveKey(opts.StarterKey, header.Salt)
+	if err != nil {
+		return err
+	}
+
+	if opts.SplitKey {
+		if contentKey, err = splitContentKey(contentKey, utKey); err != nil {
+			return err
+		}
+	}
+
+	// Create encryption writer
+	encWriter, err := newStreamEncryptWriter(out, contentKey, header.NoncePrefix, rawHeader)
+	if err != nil {
 		return err
 	}
 
 	tw := tar.NewWriter(encWriter)
-	defer tw.Close()
 
 	// Add encrypted unlock time file
-	encryptedFileContent, err := encrypt([]byte(unlockDate), DeriveKey(key, salt))
+	encryptedFileContent, err := encrypt(encodeUnlockTime(opts.UnlockTime), utKey)
 	if err != nil {
 		return err
 	}
@@ -107,13 +187,62 @@ func CreateEncryptedTarArchive(sourceDir, outputFile, unlockDate, password, key
 		return err
 	}
 
-	err = filepath.Walk(sourceDir, func(path string, info fs.FileInfo, err error) error {
+	// Add encrypted lock time file, next to the unlock time
+	if !opts.LockTime.IsZero() {
+		encryptedFileContent, err := encrypt(encodeUnlockTime(opts.LockTime), utKey)
 		if err != nil {
 			return err
 		}
 
+		if err = addFileToArchive(tw, ".lt", encryptedFileContent); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFolder(tw, sourceDir); err != nil {
+		return err
+	}
+
+	// The tar footer has to be encrypted before the last chunk is sealed
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := encWriter.Close(); err != nil {
+		return err
+	}
+
+	if opts.SigningKey != nil {
+		signature, err := sign(opts.SigningKey, digest)
+		if err != nil {
+			return err
+		}
+
+		if _, err := archiveFile.Write(signature); err != nil {
+			return err
+		}
+	}
+
+	return archiveFile.Close()
+}
+
+// writeFolder adds sourceDir and everything in it to tw, named after the folder
+func writeFolder(tw *tar.Writer, sourceDir string) error {
+	return filepath.Walk(sourceDir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Symbolic links keep their target, not the name of the link
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
 		// Create a tar header
-		header, err := tar.FileInfoHeader(info, info.Name())
+		header, err := tar.FileInfoHeader(info, link)
 		if err != nil {
 			return err
 		}
@@ -147,6 +276,4 @@ func CreateEncryptedTarArchive(sourceDir, outputFile, unlockDate, password, key
 
 		return err
 	})
-
-	return err
 }
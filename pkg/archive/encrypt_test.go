@@ -0,0 +1,55 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testKDF keeps the key derivation of test archives fast
+var testKDF = KDFParams{Algorithm: KDFPBKDF2SHA256, Iterations: 1000}
+
+// buildTestArchive builds an archive of a challenge with a single level,
+// unlocked an hour ago, and returns its path
+func buildTestArchive(t *testing.T, opts EncryptOptions) (string, error) {
+	t.Helper()
+
+	folder := filepath.Join(t.TempDir(), "ch")
+	files := map[string]string{
+		"level1/description.md": "# Level 1\n",
+		"level1/check.sh":       "#!/bin/bash\nexit 0\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(folder, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if opts.KDF.Algorithm == 0 {
+		opts.KDF = testKDF
+	}
+	if opts.UnlockTime.IsZero() {
+		opts.UnlockTime = time.Now().Add(-time.Hour)
+	}
+
+	output := filepath.Join(t.TempDir(), "ch.enc")
+
+	return output, CreateEncryptedTarArchive(folder, output, opts)
+}
+
+// mustBuildTestArchive is buildTestArchive for archives that have to be built
+func mustBuildTestArchive(t *testing.T, opts EncryptOptions) string {
+	t.Helper()
+
+	output, err := buildTestArchive(t, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return output
+}
@@ -0,0 +1,233 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ahmedYasserM/qo/pkg/clock"
+	"github.com/ahmedYasserM/qo/pkg/sandbox"
+)
+
+// Archive layout:
+//
+//	magic        4 bytes  "QOAR"
+//	version      1 byte
+//	flags        1 byte
+//	kdf          1 byte   key derivation algorithm
+//	kdf params   12 bytes three big endian uint32, meaning depends on the algorithm
+//	cipher       1 byte
+//	salt         16 bytes
+//	nonce prefix 7 bytes
+//	metadata     2 bytes big endian length, then JSON
+//	recipients   only when FlagRecipients is set: 2 bytes big endian count, then the stanzas
+//	chunks       encrypted tar stream, the whole header is authenticated with every chunk
+//	signature    64 bytes, only when FlagSigned is set
+var magic = []byte("QOAR")
+
+const formatVersion = 1
+
+// Content ciphers
+const (
+	CipherAES256GCMStream uint8 = 1
+)
+
+// Header flags
+const (
+	FlagSigned uint8 = 1 << iota
+	FlagRecipients
+	FlagSplitKey
+
+	knownFlags = FlagSigned | FlagRecipients | FlagSplitKey
+)
+
+const (
+	saltSize        = 16
+	maxMetadataSize = 1<<16 - 1
+)
+
+var ErrNotArchive = errors.New("not a qo archive")
+
+// Metadata is public information about an archive, readable without any key
+type Metadata struct {
+	Course string `json:"course,omitempty"`
+
+	// Where the unlock time is checked against, set by the instructor so
+	// students can not choose it. Archives without a policy use the local clock.
+	TimeServer string       `json:"time_server,omitempty"`
+	TimePolicy clock.Policy `json:"time_policy,omitempty"`
+
+	// Network the sandbox is connected to, set by the instructor for the same
+	// reason. Archives without a network are isolated on the loopback network.
+	Network sandbox.Network `json:"network,omitempty"`
+
+	// Namespaces the sandbox is isolated in, every namespace when empty
+	Namespaces []sandbox.Namespace `json:"namespaces,omitempty"`
+
+	// Limits are the default resource limits of the sandbox, qo start flags replace them
+	Limits *sandbox.Limits `json:"limits,omitempty"`
+}
+
+// Header is the unencrypted beginning of an archive
+type Header struct {
+	Version     uint8
+	Flags       uint8
+	KDF         KDFParams
+	Cipher      uint8
+	Salt        []byte
+	NoncePrefix []byte
+	Metadata    Metadata
+
+	// Recipients holds the content key wrapped for every student, see recipients.go
+	Recipients [][]byte
+
+	raw []byte // encoded header, authenticated with every chunk
+}
+
+// newHeader creates the header of a new archive with a random salt and nonce prefix
+func newHeader(kdf KDFParams, metadata Metadata) (*Header, error) {
+	h := &Header{
+		Version:     formatVersion,
+		KDF:         kdf,
+		Cipher:      CipherAES256GCMStream,
+		Salt:        make([]byte, saltSize),
+		NoncePrefix: make([]byte, noncePrefixSize),
+		Metadata:    metadata,
+	}
+
+	if _, err := rand.Read(h.Salt); err != nil {
+		return nil, err
+	}
+
+	if _, err := rand.Read(h.NoncePrefix); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// encode serializes the header, the result is also kept for authentication
+func (h *Header) encode() ([]byte, error) {
+	metadata, err := json.Marshal(h.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metadata) > maxMetadataSize {
+		return nil, fmt.Errorf("archive metadata is too large")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(magic)
+	buf.WriteByte(h.Version)
+	buf.WriteByte(h.Flags)
+	buf.WriteByte(h.KDF.Algorithm)
+	for _, param := range h.KDF.params() {
+		binary.Write(&buf, binary.BigEndian, param)
+	}
+	buf.WriteByte(h.Cipher)
+	buf.Write(h.Salt)
+	buf.Write(h.NoncePrefix)
+	binary.Write(&buf, binary.BigEndian, uint16(len(metadata)))
+	buf.Write(metadata)
+
+	if h.Flags&FlagRecipients != 0 {
+		if len(h.Recipients) > maxRecipients {
+			return nil, fmt.Errorf("an archive can not be built for more than %d recipients", maxRecipients)
+		}
+
+		binary.Write(&buf, binary.BigEndian, uint16(len(h.Recipients)))
+		for _, stanza := range h.Recipients {
+			buf.Write(stanza)
+		}
+	}
+
+	h.raw = buf.Bytes()
+
+	return h.raw, nil
+}
+
+// ReadHeader reads and validates the header at the beginning of an archive
+func ReadHeader(r io.Reader) (*Header, error) {
+	var raw bytes.Buffer
+	r = io.TeeReader(r, &raw)
+
+	fixed := make([]byte, len(magic)+3+12+1+saltSize+noncePrefixSize+2)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotArchive
+		}
+		return nil, err
+	}
+
+	if !bytes.Equal(fixed[:len(magic)], magic) {
+		return nil, ErrNotArchive
+	}
+	fields := fixed[len(magic):]
+
+	h := &Header{Version: fields[0], Flags: fields[1]}
+	if h.Version != formatVersion {
+		return nil, fmt.Errorf("archive format version %d is not supported by this version of qo", h.Version)
+	}
+
+	if h.Flags&^knownFlags != 0 {
+		return nil, fmt.Errorf("the archive uses features not supported by this version of qo (flags %#x)", h.Flags)
+	}
+
+	var params [3]uint32
+	for i := range params {
+		params[i] = binary.BigEndian.Uint32(fields[3+4*i:])
+	}
+	h.KDF = kdfFromParams(fields[2], params)
+	if err := h.KDF.validate(); err != nil {
+		return nil, err
+	}
+	fields = fields[15:]
+
+	h.Cipher = fields[0]
+	if h.Cipher != CipherAES256GCMStream {
+		return nil, fmt.Errorf("unsupported archive cipher %d", h.Cipher)
+	}
+	fields = fields[1:]
+
+	h.Salt = fields[:saltSize]
+	h.NoncePrefix = fields[saltSize : saltSize+noncePrefixSize]
+
+	metadata := make([]byte, binary.BigEndian.Uint16(fields[saltSize+noncePrefixSize:]))
+	if _, err := io.ReadFull(r, metadata); err != nil {
+		return nil, ErrNotArchive
+	}
+
+	if err := json.Unmarshal(metadata, &h.Metadata); err != nil {
+		return nil, fmt.Errorf("invalid archive metadata: %w", err)
+	}
+
+	if h.Flags&FlagRecipients != 0 {
+		var count uint16
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, ErrNotArchive
+		}
+
+		stanzas := make([]byte, int(count)*stanzaSize)
+		if _, err := io.ReadFull(r, stanzas); err != nil {
+			return nil, ErrNotArchive
+		}
+
+		for i := range int(count) {
+			h.Recipients = append(h.Recipients, stanzas[i*stanzaSize:(i+1)*stanzaSize])
+		}
+	}
+
+	h.raw = raw.Bytes()
+
+	return h, nil
+}
+
+// Size is the length of the encoded header, where the encrypted chunks start
+func (h *Header) Size() int64 {
+	return int64(len(h.raw))
+}
@@ -0,0 +1,122 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/ahmedYasserM/qo/pkg/clock"
+)
+
+// Offsets of the fields of an encoded header, see the archive layout
+const (
+	versionOffset  = 4
+	flagsOffset    = 5
+	kdfOffset      = 6
+	paramsOffset   = 7
+	cipherOffset   = 19
+	metadataOffset = 43
+)
+
+// encodeTestHeader encodes a header with a course name, for recipients when
+// there are any
+func encodeTestHeader(t *testing.T, kdf KDFParams, recipients int) []byte {
+	t.Helper()
+
+	h, err := newHeader(kdf, Metadata{Course: "Operating Systems", TimePolicy: clock.PolicyLocal})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if recipients > 0 {
+		h.Flags |= FlagRecipients
+		for i := range recipients {
+			h.Recipients = append(h.Recipients, bytes.Repeat([]byte{byte(i)}, stanzaSize))
+		}
+	}
+
+	raw, err := h.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes.Clone(raw)
+}
+
+func TestReadHeader(t *testing.T) {
+	for _, kdf := range []KDFParams{Argon2idDefaults, PBKDF2Defaults} {
+		raw := encodeTestHeader(t, kdf, 2)
+
+		// The chunks follow the header
+		h, err := ReadHeader(bytes.NewReader(append(bytes.Clone(raw), "chunks"...)))
+		if err != nil {
+			t.Fatalf("%s: %v", kdf, err)
+		}
+
+		if h.KDF != kdf || h.Metadata.Course != "Operating Systems" || h.Metadata.TimePolicy != clock.PolicyLocal || len(h.Recipients) != 2 {
+			t.Errorf("%s: the header is read as %+v", kdf, h)
+		}
+
+		if h.Size() != int64(len(raw)) || !bytes.Equal(h.raw, raw) {
+			t.Errorf("%s: the header is %d bytes long, want %d", kdf, h.Size(), len(raw))
+		}
+	}
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	valid := encodeTestHeader(t, Argon2idDefaults, 0)
+	withRecipients := encodeTestHeader(t, Argon2idDefaults, 2)
+
+	modify := func(raw []byte, change func([]byte)) []byte {
+		raw = bytes.Clone(raw)
+		change(raw)
+		return raw
+	}
+	setParams := func(kdf uint8, params ...uint32) []byte {
+		return modify(valid, func(b []byte) {
+			b[kdfOffset] = kdf
+			for i, param := range params {
+				binary.BigEndian.PutUint32(b[paramsOffset+4*i:], param)
+			}
+		})
+	}
+
+	tests := []struct {
+		name string
+		raw  []byte
+		want error // nil for any error but ErrNotArchive
+	}{
+		{"empty", nil, ErrNotArchive},
+		{"bad magic", modify(valid, func(b []byte) { b[0] = 'X' }), ErrNotArchive},
+		{"unknown version", modify(valid, func(b []byte) { b[versionOffset] = formatVersion + 1 }), nil},
+		{"unknown flag", modify(valid, func(b []byte) { b[flagsOffset] = 1 << 7 }), nil},
+		{"unknown kdf", modify(valid, func(b []byte) { b[kdfOffset] = 9 }), nil},
+		{"unknown cipher", modify(valid, func(b []byte) { b[cipherOffset] = 9 }), nil},
+		{"argon2 time", setParams(KDFArgon2id, maxArgon2Time+1, 64*1024, 4), nil},
+		{"argon2 memory", setParams(KDFArgon2id, 3, maxArgon2Memory+1, 4), nil},
+		{"argon2 threads", setParams(KDFArgon2id, 3, 64*1024, 256), nil},
+		{"argon2 memory per thread", setParams(KDFArgon2id, 3, 8*4-1, 4), nil},
+		{"pbkdf2 iterations", setParams(KDFPBKDF2SHA256, maxPBKDF2Iterations+1), nil},
+		{"no pbkdf2 iterations", setParams(KDFPBKDF2SHA256, 0), nil},
+		{"truncated fixed fields", valid[:metadataOffset], ErrNotArchive},
+		{"truncated metadata", valid[:len(valid)-1], ErrNotArchive},
+		{"invalid metadata", modify(valid, func(b []byte) { b[metadataOffset+2] = '[' }), nil},
+		{"truncated recipient count", withRecipients[:len(withRecipients)-2*stanzaSize-1], ErrNotArchive},
+		{"truncated recipients", withRecipients[:len(withRecipients)-1], ErrNotArchive},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, err := ReadHeader(bytes.NewReader(test.raw))
+			switch {
+			case err == nil:
+				t.Errorf("the header is read as %+v, want an error", h)
+			case test.want != nil && !errors.Is(err, test.want):
+				t.Errorf("ReadHeader returned %v, want %v", err, test.want)
+			case test.want == nil && errors.Is(err, ErrNotArchive):
+				t.Errorf("ReadHeader returned %v, want a reason", err)
+			}
+		})
+	}
+}
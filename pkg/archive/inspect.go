@@ -0,0 +1,92 @@
+package archive
+
+import (
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry describes a file of the challenge folder
+type Entry struct {
+	Name     string
+	Mode     fs.FileMode
+	Size     int64
+	Linkname string
+}
+
+// Inspection is what an archive holds, read without extracting anything
+type Inspection struct {
+	Header *Header
+
+	// UnlockTime is zero when the starter key was not given, LockTime when the archive has no close time either
+	UnlockTime time.Time
+	LockTime   time.Time
+
+	Entries []Entry
+}
+
+// Inspect decrypts an archive in memory and lists its content
+func Inspect(encryptedFile string, opts DecryptOptions) (*Inspection, error) {
+	opened, err := openArchive(encryptedFile, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := opened.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	ut, lt, header, err := opened.readTimes(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	inspection := &Inspection{Header: opened.header}
+
+	if ut != nil {
+		if inspection.UnlockTime, err = decodeUnlockTime(ut); err != nil {
+			return nil, err
+		}
+	}
+
+	if lt != nil {
+		if inspection.LockTime, err = decodeUnlockTime(lt); err != nil {
+			return nil, err
+		}
+	}
+
+	for header != nil {
+		inspection.Entries = append(inspection.Entries, Entry{
+			Name:     header.Name,
+			Mode:     header.FileInfo().Mode(),
+			Size:     header.Size,
+			Linkname: header.Linkname,
+		})
+
+		header, err = tr.Next()
+		if err == io.EOF {
+			break // End of archive
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return inspection, nil
+}
+
+// Levels returns the names of the level folders, <challenge>/<level>
+func (i *Inspection) Levels() []string {
+	var levels []string
+	for _, entry := range i.Entries {
+		if parts := strings.Split(strings.TrimSuffix(entry.Name, "/"), "/"); len(parts) == 2 && entry.Mode.IsDir() {
+			levels = append(levels, parts[1])
+		}
+	}
+	sort.Strings(levels)
+
+	return levels
+}
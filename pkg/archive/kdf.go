@@ -0,0 +1,112 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Key derivation algorithms
+const (
+	KDFPBKDF2SHA256 uint8 = 1
+	KDFArgon2id     uint8 = 2
+)
+
+// Upper bounds of the parameters accepted from an archive header, so a crafted
+// archive can not exhaust the memory of the machine opening it or keep it
+// busy for hours
+const (
+	maxArgon2Memory     = 4 * 1024 * 1024 // KiB
+	maxArgon2Time       = 16
+	maxPBKDF2Iterations = 10_000_000
+)
+
+// KDFParams selects how keys are derived from passwords
+type KDFParams struct {
+	Algorithm uint8
+
+	// PBKDF2
+	Iterations uint32
+
+	// Argon2id
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+// PBKDF2 parameters of archives created before Argon2id was supported
+var PBKDF2Defaults = KDFParams{Algorithm: KDFPBKDF2SHA256, Iterations: 100_000}
+
+// Argon2idDefaults follows the second recommended option of RFC 9106
+var Argon2idDefaults = KDFParams{Algorithm: KDFArgon2id, Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// DeriveKey generates a 32 byte key from a secret entered by the user
+func (k KDFParams) DeriveKey(secret string, salt []byte) ([]byte, error) {
+	if err := k.validate(); err != nil {
+		return nil, err
+	}
+
+	switch k.Algorithm {
+	case KDFPBKDF2SHA256:
+		return pbkdf2.Key([]byte(secret), salt, int(k.Iterations), 32, sha256.New), nil
+	default:
+		return argon2.IDKey([]byte(secret), salt, k.Time, k.Memory, k.Threads, 32), nil
+	}
+}
+
+func (k KDFParams) validate() error {
+	switch k.Algorithm {
+	case KDFPBKDF2SHA256:
+		if k.Iterations == 0 || k.Iterations > maxPBKDF2Iterations {
+			return fmt.Errorf("invalid PBKDF2 iteration count %d", k.Iterations)
+		}
+	case KDFArgon2id:
+		if k.Time == 0 || k.Time > maxArgon2Time || k.Threads == 0 {
+			return fmt.Errorf("invalid Argon2id time %d or threads %d", k.Time, k.Threads)
+		}
+		// Argon2 needs at least 8 KiB per thread
+		if k.Memory < 8*uint32(k.Threads) || k.Memory > maxArgon2Memory {
+			return fmt.Errorf("invalid Argon2id memory %d KiB", k.Memory)
+		}
+	default:
+		return fmt.Errorf("unsupported key derivation algorithm %d", k.Algorithm)
+	}
+
+	return nil
+}
+
+func (k KDFParams) String() string {
+	switch k.Algorithm {
+	case KDFPBKDF2SHA256:
+		return fmt.Sprintf("PBKDF2-SHA256 (%d iterations)", k.Iterations)
+	case KDFArgon2id:
+		return fmt.Sprintf("Argon2id (time %d, memory %d MiB, %d threads)", k.Time, k.Memory/1024, k.Threads)
+	default:
+		return fmt.Sprintf("unknown (%d)", k.Algorithm)
+	}
+}
+
+// params packs the parameters of the algorithm into the three header fields
+func (k KDFParams) params() [3]uint32 {
+	switch k.Algorithm {
+	case KDFArgon2id:
+		return [3]uint32{k.Time, k.Memory, uint32(k.Threads)}
+	default:
+		return [3]uint32{k.Iterations, 0, 0}
+	}
+}
+
+func kdfFromParams(algorithm uint8, params [3]uint32) KDFParams {
+	switch algorithm {
+	case KDFArgon2id:
+		threads := params[2]
+		if threads > 255 {
+			threads = 0 // rejected by validate
+		}
+		return KDFParams{Algorithm: algorithm, Time: params[0], Memory: params[1], Threads: uint8(threads)}
+	default:
+		return KDFParams{Algorithm: algorithm, Iterations: params[0]}
+	}
+}
@@ -0,0 +1,62 @@
+package archive
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	salt := bytes.Repeat([]byte{1}, saltSize)
+	cheapArgon2 := KDFParams{Algorithm: KDFArgon2id, Time: 1, Memory: 64, Threads: 1}
+	cheapPBKDF2 := KDFParams{Algorithm: KDFPBKDF2SHA256, Iterations: 1000}
+
+	for _, kdf := range []KDFParams{cheapArgon2, cheapPBKDF2} {
+		key, err := kdf.DeriveKey("password", salt)
+		if err != nil {
+			t.Fatalf("%s: %v", kdf, err)
+		}
+		if len(key) != 32 {
+			t.Errorf("%s: the key is %d bytes long, want 32", kdf, len(key))
+		}
+
+		again, _ := kdf.DeriveKey("password", salt)
+		other, _ := kdf.DeriveKey("Password", salt)
+		if !bytes.Equal(key, again) || bytes.Equal(key, other) {
+			t.Errorf("%s: the key does not depend on the password alone", kdf)
+		}
+	}
+}
+
+func TestKDFLimits(t *testing.T) {
+	tests := []struct {
+		kdf     KDFParams
+		wantErr bool
+	}{
+		{Argon2idDefaults, false},
+		{PBKDF2Defaults, false},
+		{KDFParams{Algorithm: KDFArgon2id, Time: maxArgon2Time, Memory: maxArgon2Memory, Threads: 255}, false},
+		{KDFParams{Algorithm: KDFArgon2id, Time: maxArgon2Time + 1, Memory: 64 * 1024, Threads: 4}, true},
+		{KDFParams{Algorithm: KDFArgon2id, Time: 0, Memory: 64 * 1024, Threads: 4}, true},
+		{KDFParams{Algorithm: KDFArgon2id, Time: 3, Memory: maxArgon2Memory + 1, Threads: 4}, true},
+		{KDFParams{Algorithm: KDFArgon2id, Time: 3, Memory: 8*4 - 1, Threads: 4}, true},
+		{KDFParams{Algorithm: KDFArgon2id, Time: 3, Memory: 64 * 1024, Threads: 0}, true},
+		{KDFParams{Algorithm: KDFPBKDF2SHA256, Iterations: maxPBKDF2Iterations}, false},
+		{KDFParams{Algorithm: KDFPBKDF2SHA256, Iterations: maxPBKDF2Iterations + 1}, true},
+		{KDFParams{Algorithm: KDFPBKDF2SHA256, Iterations: 0}, true},
+		{KDFParams{Algorithm: 9, Iterations: 1000}, true},
+	}
+
+	for _, test := range tests {
+		// DeriveKey validates first, so nothing expensive runs for the invalid parameters
+		err := test.kdf.validate()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%+v is accepted, want an error", test.kdf)
+			} else if _, err := test.kdf.DeriveKey("password", make([]byte, saltSize)); err == nil {
+				t.Errorf("a key is derived with %+v, want an error", test.kdf)
+			}
+		} else if err != nil {
+			t.Errorf("%+v is rejected: %v", test.kdf, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ahmedYasserM/qo/pkg/logger"
+)
+
+// Archives built by qo before the QOAR header have no header at all:
+//
+//	salt   16 bytes
+//	iv     16 bytes
+//	tar    encrypted with AES-256-CTR, with the key derived from the password with PBKDF2Defaults
+//
+// The tar archive starts with .ut, the unlock time in UnlockTimeLayout read
+// in the zone of the machine, encrypted like today's with the starter key.
+// Nothing authenticates the content: they are opened like unsigned archives,
+// with a warning.
+const (
+	// LegacyVersion is the format version of archives without a header
+	LegacyVersion = 0
+
+	// CipherAES256CTR is the cipher of archives without a header
+	CipherAES256CTR uint8 = 0
+)
+
+var errNotLegacyArchive = fmt.Errorf("%w, or an archive built by an older qo opened with a wrong password", ErrNotArchive)
+
+// isLegacyArchive tells whether archive could have been built before the QOAR header
+func isLegacyArchive(archive *bytes.Reader) bool {
+	start := make([]byte, saltSize+aes.BlockSize)
+	if _, err := archive.ReadAt(start, 0); err != nil {
+		return false
+	}
+
+	return !bytes.HasPrefix(start, magic)
+}
+
+// openLegacyArchive derives the keys of an archive built before the QOAR header
+func openLegacyArchive(archive *bytes.Reader, opts DecryptOptions) (*openedArchive, error) {
+	if opts.VerifyKey != nil {
+		return nil, fmt.Errorf("%w: it is not a qo archive, or it was built by an older qo and has to be rebuilt", ErrUnsigned)
+	}
+
+	if opts.Password == "" {
+		return nil, errors.New("the archive is encrypted with a password")
+	}
+
+	start := make([]byte, saltSize+aes.BlockSize)
+	if _, err := archive.ReadAt(start, 0); err != nil {
+		return nil, ErrNotArchive
+	}
+
+	header := &Header{
+		Version: LegacyVersion,
+		KDF:     PBKDF2Defaults,
+		Cipher:  CipherAES256CTR,
+		Salt:    start[:saltSize],
+	}
+
+	key, err := header.KDF.DeriveKey(opts.Password, header.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &openedArchive{
+		header:   header,
+		body:     io.NewSectionReader(archive, int64(len(start)), archive.Size()-int64(len(start))),
+		key:      key,
+		legacyIV: start[saltSize:],
+	}
+
+	// Without authentication, a wrong password only shows as an unreadable
+	// tar archive. Its first entry is always .ut.
+	tr, err := a.entries()
+	if err != nil {
+		return nil, err
+	}
+	if first, err := tr.Next(); err != nil || first.Name != ".ut" {
+		return nil, errNotLegacyArchive
+	}
+
+	if opts.StarterKey != "" {
+		if a.utKey, err = header.KDF.DeriveKey(opts.StarterKey, header.Salt); err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Warn("The archive was built by an older version of qo: nothing tells whether it was modified. Ask your instructor to rebuild it.")
+
+	return a, nil
+}
+
+// legacyEntries decrypts the tar archive of a legacy archive from its beginning
+func (a *openedArchive) legacyEntries() (*tar.Reader, error) {
+	if _, err := a.body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(a.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return tar.NewReader(cipher.StreamReader{S: cipher.NewCTR(block, a.legacyIV), R: a.body}), nil
+}
+
+// legacyUnlockTime converts the unlock time of a legacy archive, read in the
+// zone of the machine like qo used to, to the payload of today's archives
+func legacyUnlockTime(payload []byte) ([]byte, error) {
+	t, err := time.ParseInLocation(UnlockTimeLayout, string(payload), time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unlock time in the archive: %w", err)
+	}
+
+	return encodeUnlockTime(t), nil
+}
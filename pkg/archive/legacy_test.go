@@ -0,0 +1,98 @@
+package archive
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The archives of testdata were built by qo before the QOAR header, from a
+// challenge folder "legacy" with a single level, level1:
+//
+//	qo build -f legacy -p password -k starter -u "2020-01-02 03:04" -o legacy-unlocked.enc
+//	qo build -f legacy -p password -k starter -u "2999-01-02 03:04" -o legacy-locked.enc
+const (
+	legacyUnlocked = "testdata/legacy-unlocked.enc"
+	legacyLocked   = "testdata/legacy-locked.enc"
+)
+
+var legacyOptions = DecryptOptions{Password: "password", StarterKey: "starter"}
+
+func TestInspectLegacy(t *testing.T) {
+	inspection, err := Inspect(legacyUnlocked, legacyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inspection.Header.Version != LegacyVersion || inspection.Header.Cipher != CipherAES256CTR {
+		t.Errorf("the archive has version %d and cipher %d, want %d and %d",
+			inspection.Header.Version, inspection.Header.Cipher, LegacyVersion, CipherAES256CTR)
+	}
+
+	// Unlock times were read in the zone of the machine
+	want := time.Date(2020, 1, 2, 3, 4, 0, 0, time.Local)
+	if !inspection.UnlockTime.Equal(want) {
+		t.Errorf("the archive unlocks at %s, want %s", inspection.UnlockTime, want)
+	}
+
+	names := make(map[string]bool)
+	for _, entry := range inspection.Entries {
+		names[entry.Name] = true
+	}
+	for _, name := range []string{"legacy", "legacy/level1/description.md", "legacy/level1/check.sh"} {
+		if !names[name] {
+			t.Errorf("%s is missing from the entries %v", name, inspection.Entries)
+		}
+	}
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	host := useTempSandbox(t)
+
+	challenge, metadata, err := DecryptTarArchive(legacyUnlocked, legacyOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if challenge != "legacy" || metadata.TimePolicy != "" {
+		t.Errorf("the challenge is %q with the time policy %q, want legacy and none", challenge, metadata.TimePolicy)
+	}
+
+	for _, name := range []string{"rootfs/tmp/legacy/level1/description.md", "checks/legacy/level1/check.sh"} {
+		if _, err := os.Stat(filepath.Join(host, name)); err != nil {
+			t.Errorf("%s was not extracted: %v", name, err)
+		}
+	}
+}
+
+func TestLegacyErrors(t *testing.T) {
+	verifyKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		archive string
+		opts    DecryptOptions
+		want    error
+	}{
+		{"locked", legacyLocked, legacyOptions, ErrLocked},
+		{"wrong password", legacyUnlocked, DecryptOptions{Password: "wrong", StarterKey: "starter"}, ErrNotArchive},
+		{"wrong starter key", legacyUnlocked, DecryptOptions{Password: "password", StarterKey: "wrong"}, ErrWrongStarterKey},
+		{"verify key", legacyUnlocked, DecryptOptions{Password: "password", StarterKey: "starter", VerifyKey: verifyKey}, ErrUnsigned},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTempSandbox(t)
+
+			if _, _, err := DecryptTarArchive(test.archive, test.opts); !errors.Is(err, test.want) {
+				t.Errorf("DecryptTarArchive returned %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// openedArchive is an archive whose keys are derived, ready to be read
+type openedArchive struct {
+	header *Header
+	body   *io.SectionReader // the encrypted chunks, without the header and the signature
+	key    []byte            // content key
+	utKey  []byte            // starter key, nil when it was not given
+
+	legacyIV []byte // initialization vector of archives without a header, see legacy.go
+}
+
+// openArchive reads the header of an archive, verifies its signature when
+// opts.VerifyKey is set and derives the keys to read it with. The archive is
+// read into memory once, so the file can not be swapped between the
+// signature check and the decryption.
+func openArchive(path string, opts DecryptOptions) (*openedArchive, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := newOpenedArchive(bytes.NewReader(data), opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return a, nil
+}
+
+func newOpenedArchive(archive *bytes.Reader, opts DecryptOptions) (*openedArchive, error) {
+	header, err := ReadHeader(archive)
+	if errors.Is(err, ErrNotArchive) && isLegacyArchive(archive) {
+		return openLegacyArchive(archive, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.VerifyKey != nil {
+		if err := verifySignature(archive, archive.Size(), header, opts.VerifyKey); err != nil {
+			return nil, err
+		}
+	}
+
+	bodySize, err := signedBodySize(archive.Size(), header)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := contentKey(header, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &openedArchive{
+		header: header,
+		body:   io.NewSectionReader(archive, header.Size(), bodySize-header.Size()),
+		key:    key,
+	}
+
+	if opts.StarterKey != "" {
+		if a.utKey, err = header.KDF.DeriveKey(opts.StarterKey, header.Salt); err != nil {
+			return nil, err
+		}
+	}
+
+	if header.Flags&FlagSplitKey != 0 {
+		if a.utKey == nil {
+			return nil, errors.New("the archive is split-key, the starter key is needed to open it")
+		}
+
+		if a.key, err = splitContentKey(a.key, a.utKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// entries decrypts the tar archive from its beginning
+func (a *openedArchive) entries() (*tar.Reader, error) {
+	if a.header.Version == LegacyVersion {
+		return a.legacyEntries()
+	}
+
+	if _, err := a.body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	decryptReader, err := newStreamDecryptReader(a.body, a.key, a.header.NoncePrefix, a.header.raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.header.Flags&FlagSplitKey != 0 {
+		decryptReader = splitKeyErrors{decryptReader}
+	}
+
+	return tar.NewReader(decryptReader), nil
+}
+
+// readTimes reads the .ut and optional .lt entries at the beginning of tr and
+// decrypts them with the starter key, when it was given. It returns the first
+// entry after them, nil at the end of the archive.
+func (a *openedArchive) readTimes(tr *tar.Reader) (ut, lt []byte, next *tar.Header, err error) {
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return ut, lt, nil, nil // End of archive
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if header.Name != ".ut" && header.Name != ".lt" {
+			return ut, lt, header, nil
+		}
+
+		if a.utKey == nil {
+			continue
+		}
+
+		encryptedTime, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// Decrypt the unlock or lock time
+		decryptedTime, err := decrypt(encryptedTime, a.utKey)
+		if err != nil {
+			return nil, nil, nil, ErrWrongStarterKey
+		}
+
+		if a.header.Version == LegacyVersion {
+			if decryptedTime, err = legacyUnlockTime(decryptedTime); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+
+		if header.Name == ".ut" {
+			ut = decryptedTime
+		} else {
+			lt = decryptedTime
+		}
+	}
+}
+
+// splitKeyErrors reports a failing first chunk of a split-key archive as a
+// wrong password or starter key, either can be the culprit
+type splitKeyErrors struct {
+	r io.Reader
+}
+
+func (s splitKeyErrors) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if errors.Is(err, ErrWrongPassword) {
+		err = ErrWrongSplitKey
+	}
+
+	return n, err
+}
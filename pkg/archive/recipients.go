@@ -0,0 +1,83 @@
+package archive
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+// Archives built for recipients are encrypted with a random content key
+// instead of one derived from a password. The content key is wrapped for every
+// recipient: an ephemeral X25519 key agreement with the recipient's public key
+// gives, through HKDF-SHA256, the AES-GCM key the content key is sealed with.
+// The stanzas are stored in the header, so they are authenticated with every chunk.
+const (
+	recipientKeySize = 32
+	stanzaSize       = recipientKeySize + 12 + contentKeySize + 16 // ephemeral key, nonce, sealed key, tag
+	contentKeySize   = 32
+	maxRecipients    = 1<<16 - 1
+	recipientInfo    = "qo recipient"
+)
+
+var ErrNotRecipient = errors.New("the archive was not built for this identity")
+
+// wrapKey seals contentKey for recipient
+func wrapKey(contentKey []byte, recipient *ecdh.PublicKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappingKey, err := stanzaKey(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := encrypt(contentKey, wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ephemeral.PublicKey().Bytes(), sealed...), nil
+}
+
+// unwrapKey finds the stanza sealed for identity and opens it
+func unwrapKey(stanzas [][]byte, identity *ecdh.PrivateKey) ([]byte, error) {
+	for _, stanza := range stanzas {
+		ephemeral, err := ecdh.X25519().NewPublicKey(stanza[:recipientKeySize])
+		if err != nil {
+			continue
+		}
+
+		shared, err := identity.ECDH(ephemeral)
+		if err != nil {
+			continue
+		}
+
+		wrappingKey, err := stanzaKey(shared, ephemeral.Bytes(), identity.PublicKey().Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		// Stanzas sealed for other students do not open
+		if contentKey, err := decrypt(stanza[recipientKeySize:], wrappingKey); err == nil {
+			return contentKey, nil
+		}
+	}
+
+	return nil, ErrNotRecipient
+}
+
+// stanzaKey derives the wrapping key of a stanza, bound to both public keys
+func stanzaKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+
+	return hkdf.Key(sha256.New, shared, salt, recipientInfo, 32)
+}
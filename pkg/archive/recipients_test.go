@@ -0,0 +1,141 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestIdentities(t *testing.T, count int) ([]*ecdh.PrivateKey, []*ecdh.PublicKey) {
+	t.Helper()
+
+	var identities []*ecdh.PrivateKey
+	var recipients []*ecdh.PublicKey
+	for range count {
+		identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		identities = append(identities, identity)
+		recipients = append(recipients, identity.PublicKey())
+	}
+
+	return identities, recipients
+}
+
+func TestWrapKey(t *testing.T) {
+	identities, recipients := newTestIdentities(t, 3)
+	contentKey := bytes.Repeat([]byte{7}, contentKeySize)
+
+	var stanzas [][]byte
+	for _, recipient := range recipients {
+		stanza, err := wrapKey(contentKey, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stanza) != stanzaSize {
+			t.Fatalf("the stanza is %d bytes long, want %d", len(stanza), stanzaSize)
+		}
+		stanzas = append(stanzas, stanza)
+	}
+
+	// Every recipient finds their own stanza, wherever it is
+	for i, identity := range identities {
+		key, err := unwrapKey(stanzas, identity)
+		if err != nil {
+			t.Fatalf("recipient %d: %v", i, err)
+		}
+		if !bytes.Equal(key, contentKey) {
+			t.Errorf("recipient %d unwraps another key", i)
+		}
+	}
+
+	outsiders, _ := newTestIdentities(t, 1)
+	if _, err := unwrapKey(stanzas, outsiders[0]); !errors.Is(err, ErrNotRecipient) {
+		t.Errorf("another identity unwraps the key with the error %v, want %v", err, ErrNotRecipient)
+	}
+
+	// A modified stanza does not open, the others still do
+	for _, offset := range []int{0, recipientKeySize, stanzaSize - 1} {
+		modified := [][]byte{bytes.Clone(stanzas[0]), stanzas[1]}
+		modified[0][offset] ^= 1
+
+		if _, err := unwrapKey(modified, identities[0]); !errors.Is(err, ErrNotRecipient) {
+			t.Errorf("byte %d of the stanza modified: unwrapped with the error %v, want %v", offset, err, ErrNotRecipient)
+		}
+		if _, err := unwrapKey(modified, identities[1]); err != nil {
+			t.Errorf("byte %d of another stanza modified: %v", offset, err)
+		}
+	}
+}
+
+func TestRecipientsArchive(t *testing.T) {
+	identities, recipients := newTestIdentities(t, 3)
+	archive := mustBuildTestArchive(t, EncryptOptions{StarterKey: "starter", Recipients: recipients})
+
+	for i, identity := range identities {
+		inspection, err := Inspect(archive, DecryptOptions{Identity: identity, StarterKey: "starter"})
+		if err != nil {
+			t.Fatalf("recipient %d: %v", i, err)
+		}
+		if len(inspection.Header.Recipients) != 3 || inspection.UnlockTime.IsZero() {
+			t.Errorf("recipient %d reads %d stanzas and the unlock time %s", i, len(inspection.Header.Recipients), inspection.UnlockTime)
+		}
+	}
+
+	outsiders, _ := newTestIdentities(t, 1)
+	if _, err := Inspect(archive, DecryptOptions{Identity: outsiders[0]}); !errors.Is(err, ErrNotRecipient) {
+		t.Errorf("another identity opens the archive with the error %v, want %v", err, ErrNotRecipient)
+	}
+
+	if _, err := Inspect(archive, DecryptOptions{Password: "password"}); err == nil {
+		t.Error("the archive built for recipients is opened with a password")
+	}
+}
+
+// TestRecipientsArchiveModified modifies the stanza of the first recipient in
+// the header of an archive: it no longer opens for them, and the header no
+// longer authenticates the content for the others
+func TestRecipientsArchiveModified(t *testing.T) {
+	identities, recipients := newTestIdentities(t, 2)
+	archive := mustBuildTestArchive(t, EncryptOptions{StarterKey: "starter", Recipients: recipients})
+
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[header.Size()-2*stanzaSize+recipientKeySize] ^= 1
+
+	modified := filepath.Join(t.TempDir(), "modified.enc")
+	if err := os.WriteFile(modified, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Inspect(modified, DecryptOptions{Identity: identities[0]}); !errors.Is(err, ErrNotRecipient) {
+		t.Errorf("the first recipient opens the archive with the error %v, want %v", err, ErrNotRecipient)
+	}
+	if _, err := Inspect(modified, DecryptOptions{Identity: identities[1]}); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("the second recipient opens the archive with the error %v, want %v", err, ErrWrongPassword)
+	}
+}
+
+func TestPasswordAndRecipients(t *testing.T) {
+	_, recipients := newTestIdentities(t, 1)
+
+	archive, err := buildTestArchive(t, EncryptOptions{Password: "password", StarterKey: "starter", Recipients: recipients})
+	if err == nil {
+		t.Error("an archive is built with both a password and recipients")
+	}
+	if _, statErr := os.Stat(archive); statErr == nil {
+		t.Errorf("%s was written", archive)
+	}
+}
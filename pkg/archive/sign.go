@@ -0,0 +1,73 @@
+package archive
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"io"
+)
+
+// Signed archives have the FlagSigned header flag set and end with an Ed25519ph
+// signature of everything before it: the header and the encrypted chunks.
+// As the header is authenticated with every chunk, the flag can not be
+// removed without the password.
+const signatureContext = "qo archive"
+
+var (
+	ErrUnsigned     = errors.New("the archive is not signed")
+	ErrBadSignature = errors.New("the archive signature is not valid, it was not built by your instructor or was modified")
+)
+
+func signatureOptions() *ed25519.Options {
+	return &ed25519.Options{Hash: crypto.SHA512, Context: signatureContext}
+}
+
+// sign returns the trailer of an archive hashed into digest
+func sign(key ed25519.PrivateKey, digest hash.Hash) ([]byte, error) {
+	return key.Sign(nil, digest.Sum(nil), signatureOptions())
+}
+
+// signedBodySize returns where the encrypted chunks of an archive of size
+// bytes end, before the signature of signed archives.
+func signedBodySize(size int64, header *Header) (int64, error) {
+	if header.Flags&FlagSigned != 0 {
+		size -= ed25519.SignatureSize
+	}
+
+	if size < header.Size() {
+		return 0, ErrCorrupted
+	}
+
+	return size, nil
+}
+
+// verifySignature checks the signature at the end of a signed archive of
+// archiveSize bytes against key
+func verifySignature(archive io.ReaderAt, archiveSize int64, header *Header, key ed25519.PublicKey) error {
+	if header.Flags&FlagSigned == 0 {
+		return ErrUnsigned
+	}
+
+	size, err := signedBodySize(archiveSize, header)
+	if err != nil {
+		return err
+	}
+
+	digest := sha512.New()
+	if _, err := io.Copy(digest, io.NewSectionReader(archive, 0, size)); err != nil {
+		return err
+	}
+
+	signature := make([]byte, ed25519.SignatureSize)
+	if _, err := archive.ReadAt(signature, size); err != nil {
+		return err
+	}
+
+	if err := ed25519.VerifyWithOptions(key, digest.Sum(nil), signature, signatureOptions()); err != nil {
+		return ErrBadSignature
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package archive
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+)
+
+// In split-key archives the content key is derived from both the password (or
+// the student's identity) and the starter key, which is only announced in the
+// room when the exam starts. Having the archive and the password early is not
+// enough to read the challenges.
+const splitKeyInfo = "qo split key"
+
+var ErrWrongSplitKey = errors.New("wrong password or starter key, or the archive is corrupted")
+
+// splitContentKey combines the key opened with the password or identity and
+// the key derived from the starter key
+func splitContentKey(key, starterKey []byte) ([]byte, error) {
+	secret := append(append([]byte{}, key...), starterKey...)
+
+	return hkdf.Key(sha256.New, secret, nil, splitKeyInfo, contentKeySize)
+}
@@ -0,0 +1,94 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestSplitKeyArchive(t *testing.T) {
+	archive := mustBuildTestArchive(t, EncryptOptions{Password: "password", StarterKey: "starter", SplitKey: true})
+
+	inspection, err := Inspect(archive, DecryptOptions{Password: "password", StarterKey: "starter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspection.Header.Flags&FlagSplitKey == 0 || inspection.UnlockTime.IsZero() {
+		t.Errorf("the archive is read with the flags %#x and the unlock time %s", inspection.Header.Flags, inspection.UnlockTime)
+	}
+
+	tests := []struct {
+		name string
+		opts DecryptOptions
+		want error // nil for any error
+	}{
+		{"without the starter key", DecryptOptions{Password: "password"}, nil},
+		{"wrong starter key", DecryptOptions{Password: "password", StarterKey: "wrong"}, ErrWrongSplitKey},
+		{"wrong password", DecryptOptions{Password: "wrong", StarterKey: "starter"}, ErrWrongSplitKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Inspect(archive, test.opts)
+			if err == nil || test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("Inspect returned %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+// TestSplitKeyContentKey decrypts a split-key archive with the key derived
+// from the password alone, which the students have before the exam
+func TestSplitKeyContentKey(t *testing.T) {
+	archive := mustBuildTestArchive(t, EncryptOptions{Password: "password", StarterKey: "starter", SplitKey: true})
+
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := ReadHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passwordKey, err := header.KDF.DeriveKey("password", header.Salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newStreamDecryptReader(bytes.NewReader(data[header.Size():]), passwordKey, header.NoncePrefix, header.raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plain, err := io.ReadAll(r); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("the password key decrypts %d bytes with the error %v, want %v", len(plain), err, ErrWrongPassword)
+	}
+}
+
+// TestStarterKeyWithoutSplitKey checks that the starter key given for an
+// archive that is not split-key is still checked, not ignored
+func TestStarterKeyWithoutSplitKey(t *testing.T) {
+	archive := mustBuildTestArchive(t, EncryptOptions{Password: "password", StarterKey: "starter"})
+
+	if _, err := Inspect(archive, DecryptOptions{Password: "password", StarterKey: "wrong"}); !errors.Is(err, ErrWrongStarterKey) {
+		t.Errorf("Inspect returned %v, want %v", err, ErrWrongStarterKey)
+	}
+
+	useTempSandbox(t)
+	if _, _, err := DecryptTarArchive(archive, DecryptOptions{Password: "password", StarterKey: "wrong"}); !errors.Is(err, ErrWrongStarterKey) {
+		t.Errorf("DecryptTarArchive returned %v, want %v", err, ErrWrongStarterKey)
+	}
+
+	// Without split-key, the password alone reads the archive but not its times
+	inspection, err := Inspect(archive, DecryptOptions{Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inspection.UnlockTime.IsZero() {
+		t.Errorf("the unlock time %s is read without the starter key", inspection.UnlockTime)
+	}
+}
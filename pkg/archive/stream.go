@@ -0,0 +1,193 @@
+package archive
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The archive content is encrypted with AES-256-GCM in fixed size chunks,
+// following the STREAM construction: every chunk is authenticated on its own
+// and its nonce is made of a random prefix, the chunk counter and a flag
+// marking the last chunk. Reordered, truncated or modified chunks are detected
+// while the archive is still streamed. The archive header is the additional
+// data of every chunk, so it can not be modified either.
+const (
+	chunkSize       = 64 * 1024
+	noncePrefixSize = 7
+)
+
+var (
+	ErrWrongPassword = errors.New("wrong password, or the archive is corrupted")
+	ErrCorrupted     = errors.New("the archive is corrupted or was tampered with")
+)
+
+func newChunkAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce builds the nonce of a chunk: prefix || counter || last flag
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+// streamWriter encrypts everything written to it chunk by chunk. Close must be
+// called to write the last chunk.
+type streamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	counter uint32
+	buf     []byte
+}
+
+// newStreamEncryptWriter returns a writer encrypting into w, the chunks are
+// authenticated together with aad.
+func newStreamEncryptWriter(w io.Writer, key, prefix, aad []byte) (io.WriteCloser, error) {
+	aead, err := newChunkAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		aad:    aad,
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data comes, it may be the last one
+		if len(s.buf) == chunkSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(s.buf[len(s.buf):chunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the last chunk, it does not close the underlying writer
+func (s *streamWriter) Close() error {
+	return s.seal(true)
+}
+
+func (s *streamWriter) seal(last bool) error {
+	if s.counter == ^uint32(0) {
+		return errors.New("archive is too large")
+	}
+
+	sealed := s.aead.Seal(nil, chunkNonce(s.prefix, s.counter, last), s.buf, s.aad)
+	if _, err := s.w.Write(sealed); err != nil {
+		return err
+	}
+
+	s.counter++
+	s.buf = s.buf[:0]
+
+	return nil
+}
+
+// streamReader decrypts and authenticates a stream written by streamWriter
+type streamReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	counter uint32
+	sealed  []byte // read ahead by one byte to find out whether a chunk is the last one
+	plain   []byte
+	done    bool
+}
+
+func newStreamDecryptReader(r io.Reader, key, prefix, aad []byte) (io.Reader, error) {
+	aead, err := newChunkAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader{
+		r:      r,
+		aead:   aead,
+		prefix: prefix,
+		aad:    aad,
+		sealed: make([]byte, 0, chunkSize+aead.Overhead()+1),
+	}, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+
+		if err := s.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+
+	return n, nil
+}
+
+// open reads and authenticates the next chunk
+func (s *streamReader) open() error {
+	sealedSize := chunkSize + s.aead.Overhead()
+
+	n, err := io.ReadFull(s.r, s.sealed[len(s.sealed):cap(s.sealed)])
+	s.sealed = s.sealed[:len(s.sealed)+n]
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+
+	// Only the last chunk can be followed by nothing
+	last := len(s.sealed) <= sealedSize
+	chunk := s.sealed
+	if !last {
+		chunk = s.sealed[:sealedSize]
+	}
+
+	plain, err := s.aead.Open(nil, chunkNonce(s.prefix, s.counter, last), chunk, s.aad)
+	if err != nil {
+		if s.counter == 0 {
+			return ErrWrongPassword
+		}
+		return ErrCorrupted
+	}
+
+	s.plain = plain
+	s.counter++
+	s.done = last
+
+	// Keep the byte read ahead for the next chunk
+	s.sealed = append(s.sealed[:0], s.sealed[len(chunk):]...)
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+// sealStream encrypts plain with streamWriter, writing it in uneven pieces
+func sealStream(t *testing.T, plain, key, prefix, aad []byte) []byte {
+	t.Helper()
+
+	var sealed bytes.Buffer
+	w, err := newStreamEncryptWriter(&sealed, key, prefix, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for rest := plain; len(rest) > 0; {
+		n := min(len(rest), 1000)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return sealed.Bytes()
+}
+
+// openStream decrypts sealed with streamReader
+func openStream(sealed, key, prefix, aad []byte) ([]byte, error) {
+	r, err := newStreamDecryptReader(bytes.NewReader(sealed), key, prefix, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+func randomBytes(t *testing.T, size int) []byte {
+	t.Helper()
+
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := randomBytes(t, 32)
+	prefix := randomBytes(t, noncePrefixSize)
+	aad := []byte("header")
+
+	for _, size := range []int{0, 1, chunkSize, chunkSize + 1, 3*chunkSize + 7} {
+		plain := randomBytes(t, size)
+
+		sealed := sealStream(t, plain, key, prefix, aad)
+		chunks := size/chunkSize + 1
+		if size > 0 && size%chunkSize == 0 {
+			chunks--
+		}
+		if want := size + chunks*16; len(sealed) != want {
+			t.Errorf("%d bytes are sealed into %d bytes, want %d", size, len(sealed), want)
+		}
+
+		opened, err := openStream(sealed, key, prefix, aad)
+		if err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+			continue
+		}
+
+		if !bytes.Equal(opened, plain) {
+			t.Errorf("%d bytes are opened into %d different bytes", size, len(opened))
+		}
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	key := randomBytes(t, 32)
+	prefix := randomBytes(t, noncePrefixSize)
+	aad := []byte("header")
+
+	// Three chunks, the last one shorter
+	plain := randomBytes(t, 2*chunkSize+100)
+	sealed := sealStream(t, plain, key, prefix, aad)
+	sealedSize := chunkSize + 16
+
+	modify := func(change func([]byte) []byte) []byte {
+		return change(bytes.Clone(sealed))
+	}
+	flip := func(offset int) []byte {
+		return modify(func(b []byte) []byte {
+			b[offset] ^= 1
+			return b
+		})
+	}
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		key    []byte
+		prefix []byte
+		aad    []byte
+		want   error
+	}{
+		{"flipped byte in the first chunk", flip(10), key, prefix, aad, ErrWrongPassword},
+		{"flipped byte in a chunk", flip(sealedSize + 10), key, prefix, aad, ErrCorrupted},
+		{"flipped tag of the last chunk", flip(len(sealed) - 1), key, prefix, aad, ErrCorrupted},
+		{"truncated last chunk", sealed[:len(sealed)-1], key, prefix, aad, ErrCorrupted},
+		{"dropped last chunk", sealed[:2*sealedSize], key, prefix, aad, ErrCorrupted},
+		{"dropped every chunk", sealed[:0], key, prefix, aad, ErrWrongPassword},
+		{"appended data", append(bytes.Clone(sealed), 0), key, prefix, aad, ErrCorrupted},
+		{"swapped chunks", modify(func(b []byte) []byte {
+			first := bytes.Clone(b[:sealedSize])
+			copy(b, b[sealedSize:2*sealedSize])
+			copy(b[sealedSize:], first)
+			return b
+		}), key, prefix, aad, ErrWrongPassword},
+		{"modified header", sealed, key, prefix, []byte("Header"), ErrWrongPassword},
+		{"other nonce prefix", sealed, key, randomBytes(t, noncePrefixSize), aad, ErrWrongPassword},
+		{"wrong key", sealed, randomBytes(t, 32), prefix, aad, ErrWrongPassword},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opened, err := openStream(test.sealed, test.key, test.prefix, test.aad)
+			if !errors.Is(err, test.want) {
+				t.Errorf("the stream is opened into %d bytes with the error %v, want %v", len(opened), err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package archive
+
+import (
+	"fmt"
+	"time"
+)
+
+// UnlockTimeLayout is the human-friendly unlock time format, read in the zone given with it
+const UnlockTimeLayout = "2006-01-02 15:04"
+
+// ParseUnlockTime accepts an RFC 3339 time, which carries its own offset, or
+// a time in UnlockTimeLayout read in the named timezone ("Local" for the
+// zone of this machine).
+func ParseUnlockTime(value, timezone string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	t, err := time.ParseInLocation(UnlockTimeLayout, value, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid unlock time %q, expected RFC 3339 (e.g. 2025-07-10T09:30:00+03:00) or \"YYYY-MM-DD HH:MM\"", value)
+	}
+
+	return t, nil
+}
+
+// encodeUnlockTime stores t as an absolute UTC instant, so the archive unlocks
+// at the same moment whatever the timezone of the student's machine.
+func encodeUnlockTime(t time.Time) []byte {
+	return []byte(t.UTC().Format(time.RFC3339))
+}
+
+// decodeUnlockTime reads the .ut payload, an instant written by encodeUnlockTime
+func decodeUnlockTime(payload []byte) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, string(payload))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid unlock time in the archive: %w", err)
+	}
+
+	return t, nil
+}
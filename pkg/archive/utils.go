@@ -1,48 +1,220 @@
 package archive
 
 import (
-	"crypto/sha256"
+	"bufio"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
-	"golang.org/x/crypto/pbkdf2"
+	"github.com/ahmedYasserM/qo/pkg/manifest"
+	"github.com/ahmedYasserM/qo/pkg/sandbox"
 )
 
-// Generate a 32 byte key from a password entered by the user
-func DeriveKey(password string, salt []byte) []byte {
-	return pbkdf2.Key([]byte(password), salt, 100_000, 32, sha256.New)
-}
+const (
+	// maxFileSize is the largest file a challenge folder can hold
+	maxFileSize = 32 << 20
+	// maxFolderSize is the largest total size of a challenge folder, it is extracted in the student's /tmp
+	maxFolderSize = 128 << 20
+)
+
+// Files allowed at the root of a challenge folder, next to the level folders
+var rootFiles = []string{manifest.FileName, "README.md"}
 
+// IsValidFolderStructure lints a challenge folder before it is archived. Every
+// problem found is reported at once, joined in the returned error.
 func IsValidFolderStructure(root string) error {
 	entries, err := os.ReadDir(root)
 	if err != nil {
 		return err
 	}
 
-	// Check for files in root
+	var problems []error
+
+	// Check for files in root, only the manifest and the README are allowed
+	var levels []string
 	for _, entry := range entries {
-		if !entry.IsDir() {
-			return fmt.Errorf("File %q found in root directory; only subdirectories are allowed", entry.Name())
+		if entry.IsDir() {
+			levels = append(levels, entry.Name())
+		} else if !slices.Contains(rootFiles, entry.Name()) {
+			problems = append(problems, fmt.Errorf("File %q found in root directory; only subdirectories, %s are allowed", entry.Name(), strings.Join(rootFiles, " and ")))
 		}
 	}
 
+	if len(levels) == 0 {
+		problems = append(problems, fmt.Errorf("%q has no level folders", root))
+	}
+
 	// Check each subdirectory
-	for _, entry := range entries {
-		subDirPath := filepath.Join(root, entry.Name())
-		checkFilePath := filepath.Join(subDirPath, "check.sh")
+	for _, level := range levels {
+		problems = append(problems, lintLevel(filepath.Join(root, level))...)
+	}
+
+	problems = append(problems, lintTree(root)...)
+
+	challengeManifest, err := manifest.Load(root)
+	if err != nil {
+		problems = append(problems, err)
+	} else if challengeManifest != nil {
+		problems = append(problems, challengeManifest.Validate(levels, func(binary string) bool {
+			_, err := sandbox.LookPath(binary)
+			return err == nil
+		}))
+	}
+
+	return errors.Join(problems...)
+}
+
+// lintLevel checks the files every level folder needs
+func lintLevel(dir string) []error {
+	var problems []error
+
+	descriptionPath := filepath.Join(dir, "description.md")
+	if info, err := os.Lstat(descriptionPath); err != nil {
+		problems = append(problems, fmt.Errorf("%q is missing 'description.md'", dir))
+	} else if !info.Mode().IsRegular() {
+		problems = append(problems, fmt.Errorf("%q is not a regular file", descriptionPath))
+	}
+
+	filesPath := filepath.Join(dir, "files")
+	if info, err := os.Lstat(filesPath); err == nil && !info.IsDir() {
+		problems = append(problems, fmt.Errorf("%q is not a directory", filesPath))
+	}
+
+	checkFilePath := filepath.Join(dir, "check.sh")
+
+	// Ensure check.sh exists
+	info, err := os.Lstat(checkFilePath)
+	if os.IsNotExist(err) {
+		return append(problems, fmt.Errorf("%q is missing 'check.sh'", dir))
+	}
+	if err != nil {
+		return append(problems, err)
+	}
+
+	mode := info.Mode()
+	if !mode.IsRegular() || mode&0111 == 0 {
+		return append(problems, fmt.Errorf("%q file is not executable", checkFilePath))
+	}
+
+	if err := lintShebang(checkFilePath); err != nil {
+		problems = append(problems, err)
+	}
+
+	return problems
+}
+
+// lintShebang checks that the interpreter of a script is in the sandbox
+// rootfs, check scripts run inside the sandbox and not on the host
+func lintShebang(script string) error {
+	file, err := os.Open(script)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("%q is empty", script)
+	}
+
+	interpreter, found := strings.CutPrefix(strings.TrimSpace(line), "#!")
+	fields := strings.Fields(interpreter)
+	if !found || len(fields) == 0 {
+		return fmt.Errorf("%q has no shebang line, e.g. #!/bin/sh", script)
+	}
 
-		// Ensure check.sh exists
-		info, err := os.Stat(checkFilePath)
-		if os.IsNotExist(err) {
-			return fmt.Errorf("%q is missing 'check.sh'", subDirPath)
+	if _, err := sandbox.LookPath(fields[0]); err != nil {
+		return fmt.Errorf("%q: interpreter %s is not in the sandbox rootfs", script, fields[0])
+	}
+
+	// #!/usr/bin/env bash looks the interpreter up in the sandbox PATH
+	if filepath.Base(fields[0]) == "env" && len(fields) > 1 && !strings.HasPrefix(fields[1], "-") {
+		if _, err := sandbox.LookPath(fields[1]); err != nil {
+			return fmt.Errorf("%q: interpreter %s is not in the sandbox rootfs", script, fields[1])
 		}
+	}
 
-		mode := info.Mode()
-		if !mode.IsRegular() || mode&0111 == 0 {
-			return fmt.Errorf("%q file is not executable", checkFilePath)
+	return nil
+}
+
+// lintTree checks every file of the challenge folder: file types, symbolic
+// links and sizes
+func lintTree(root string) []error {
+	var problems []error
+	var total int64
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+		case mode.IsRegular():
+			if info.Size() > maxFileSize {
+				problems = append(problems, fmt.Errorf("%q is %d MiB, files are limited to %d MiB", path, info.Size()>>20, maxFileSize>>20))
+			}
+			total += info.Size()
+		case mode&fs.ModeSymlink != 0:
+			if err := lintSymlink(root, path); err != nil {
+				problems = append(problems, err)
+			}
+		default:
+			problems = append(problems, fmt.Errorf("%q is a %s, only files, directories and symbolic links can be archived", path, fileType(mode)))
 		}
+
+		return nil
+	})
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	if total > maxFolderSize {
+		problems = append(problems, fmt.Errorf("%q holds %d MiB of files, challenges are limited to %d MiB", root, total>>20, maxFolderSize>>20))
+	}
+
+	return problems
+}
+
+// lintSymlink rejects symbolic links that point outside the challenge folder.
+// Absolute targets would resolve in the student's sandbox, not in the folder.
+func lintSymlink(root, link string) error {
+	target, err := os.Readlink(link)
+	if err != nil {
+		return err
+	}
+
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("%q is an absolute symbolic link to %s, use a link relative to the challenge folder", link, target)
+	}
+
+	rel, err := filepath.Rel(root, filepath.Join(filepath.Dir(link), target))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%q links to %s, outside the challenge folder", link, target)
 	}
 
 	return nil
 }
+
+// fileType names the type of a special file for error messages
+func fileType(mode fs.FileMode) string {
+	switch {
+	case mode&fs.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	case mode&fs.ModeDevice != 0:
+		return "device"
+	default:
+		return "special file"
+	}
+}
@@ -0,0 +1,177 @@
+package audit
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hook is the rcfile of the student's shell, it reports every command line to
+// the pipe the shell inherits as HookFd
+//
+//go:embed hook.bash
+var Hook []byte
+
+const (
+	// HookPath is where the hook is written inside the sandbox
+	HookPath = "/run/qo/bashrc"
+
+	// HookFd is the file descriptor of the shell the hook takes its pipe from,
+	// it must match hook.bash
+	HookFd = 3
+
+	// maxField is the longest field of a record, longer records are skipped
+	maxField = 64 << 10
+)
+
+// ErrInvalidRecord is returned for records that were not written by the hook.
+// The reader skips to the next record, so reading can go on.
+var ErrInvalidRecord = errors.New("invalid command record")
+
+// Record is a single command line executed by the student
+type Record struct {
+	Time     time.Time     `json:"time"`
+	Cwd      string        `json:"cwd"`
+	Command  string        `json:"command"`
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Reader decodes the records written by the hook
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, maxField)}
+}
+
+// Read returns the next record, or io.EOF once the hook is gone. Records are
+// NUL terminated fields ending with an empty field, so after an invalid record
+// the next one is read from its start.
+func (r *Reader) Read() (Record, error) {
+	var fields []string
+	valid, long := true, false
+	for {
+		field, err := r.r.ReadSlice(0)
+		if err == bufio.ErrBufferFull {
+			valid, long = false, true
+			continue
+		}
+		if err == io.EOF {
+			if len(fields) == 0 && len(field) == 0 && valid {
+				return Record{}, io.EOF
+			}
+			return Record{}, fmt.Errorf("%w: truncated", ErrInvalidRecord)
+		}
+		if err != nil {
+			return Record{}, err
+		}
+
+		// The end of a field longer than the buffer
+		if long {
+			long = false
+			continue
+		}
+
+		if len(field) == 1 {
+			break
+		}
+
+		if len(fields) < 5 {
+			fields = append(fields, string(field[:len(field)-1]))
+		} else {
+			valid = false
+		}
+	}
+
+	if !valid || len(fields) != 5 {
+		return Record{}, fmt.Errorf("%w: expected 5 fields", ErrInvalidRecord)
+	}
+
+	start, err := parseEpoch(fields[0])
+	if err != nil {
+		return Record{}, err
+	}
+
+	end, err := parseEpoch(fields[1])
+	if err != nil {
+		return Record{}, err
+	}
+
+	exitCode, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: invalid exit status %q", ErrInvalidRecord, fields[2])
+	}
+
+	return Record{
+		Time:     start,
+		Cwd:      fields[3],
+		Command:  fields[4],
+		ExitCode: exitCode,
+		Duration: end.Sub(start),
+	}, nil
+}
+
+// parseEpoch parses bash's $EPOCHREALTIME, seconds with a locale dependent
+// decimal separator and microseconds.
+func parseEpoch(s string) (time.Time, error) {
+	sec, frac, _ := strings.Cut(strings.Replace(s, ",", ".", 1), ".")
+
+	secs, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid timestamp %q", ErrInvalidRecord, s)
+	}
+
+	var nsecs int64
+	if frac != "" {
+		frac = (frac + "000000000")[:9]
+		if nsecs, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, fmt.Errorf("%w: invalid timestamp %q", ErrInvalidRecord, s)
+		}
+	}
+
+	return time.Unix(secs, nsecs), nil
+}
+
+// Log writes records as JSON lines
+type Log struct {
+	file   *os.File
+	enc    *json.Encoder
+	Count  int
+	Failed int // commands with a non-zero exit status
+}
+
+func Create(path string) (*Log, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Log{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Add appends a record to the log
+func (l *Log) Add(r Record) error {
+	if err := l.enc.Encode(r); err != nil {
+		return err
+	}
+
+	l.Count++
+	if r.ExitCode != 0 {
+		l.Failed++
+	}
+
+	return nil
+}
+
+func (l *Log) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,57 @@
+# qo command audit hook, used as the rcfile of the student's shell.
+#
+# Every command line is reported to the sandbox init through the pipe the
+# shell inherits as fd 3, as five NUL terminated fields: start time, end time,
+# exit status, working directory and the command line itself, then an empty
+# field ending the record.
+
+# fd 3 is left to the student, the pipe moves to a descriptor picked by bash
+exec {__qo_audit_fd}>&3 3>&-
+readonly __qo_audit_fd
+
+[ -f ~/.bashrc ] && . ~/.bashrc
+
+__qo_audit_prompt=$PROMPT_COMMAND
+__qo_audit_start=
+__qo_audit_last=
+
+# Runs before every simple command, only the first one of a command line counts
+__qo_audit_preexec() {
+	[ -n "$__qo_audit_start" ] && return
+	[ "$BASH_COMMAND" = "$PROMPT_COMMAND" ] && return
+
+	__qo_audit_start=$EPOCHREALTIME
+	__qo_audit_cwd=$PWD
+	__qo_audit_command=$BASH_COMMAND
+}
+
+# Runs before every prompt, once the command line is done
+__qo_audit_precmd() {
+	local status=$? end=$EPOCHREALTIME number=0 entry= command=
+
+	if [[ $(HISTTIMEFORMAT= builtin history 1) =~ ^\ *([0-9]+)\*?\ \ (.*)$ ]]; then
+		number=${BASH_REMATCH[1]}
+		entry=${BASH_REMATCH[2]}
+	fi
+
+	# The full command line comes from the history, the trap only sees its first command
+	if [ -n "$__qo_audit_last" ] && [ "$number" != "$__qo_audit_last" ]; then
+		command=$entry
+	elif [ -n "$__qo_audit_last" ] && [ -n "$__qo_audit_start" ]; then
+		command=$__qo_audit_command
+	fi
+	__qo_audit_last=$number
+
+	if [ -n "$command" ]; then
+		printf '%s\0%s\0%s\0%s\0%s\0\0' "${__qo_audit_start:-$end}" "$end" "$status" "${__qo_audit_cwd:-$PWD}" "$command" >&"$__qo_audit_fd"
+	fi
+
+	__qo_audit_start=
+	__qo_audit_cwd=
+
+	eval "$__qo_audit_prompt"
+}
+
+trap __qo_audit_preexec DEBUG
+PROMPT_COMMAND=__qo_audit_precmd
+readonly PROMPT_COMMAND
@@ -0,0 +1,95 @@
+package clock
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ahmedYasserM/qo/pkg/logger"
+)
+
+// Source tells the current time
+type Source interface {
+	Now() (time.Time, error)
+	String() string
+}
+
+// Policy decides which time unlock times are checked against, and what to do
+// when the trusted time server can not be reached
+type Policy string
+
+const (
+	// PolicyRequire refuses to go on without an answer from the time server
+	PolicyRequire Policy = "require"
+	// PolicyFallback uses the local clock, with a warning, when the time server does not answer
+	PolicyFallback Policy = "fallback"
+	// PolicyLocal only trusts the local clock, which the student can change
+	PolicyLocal Policy = "local"
+)
+
+// ParsePolicy checks that s names a known policy
+func ParsePolicy(s string) (Policy, error) {
+	switch policy := Policy(s); policy {
+	case PolicyRequire, PolicyFallback, PolicyLocal:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown time policy %q, expected \"require\", \"fallback\" or \"local\"", s)
+	}
+}
+
+// New returns the source to check times against following policy, servers
+// is a comma separated list of time servers
+func New(servers string, policy Policy) (Source, error) {
+	switch policy {
+	case PolicyLocal:
+		return Local{}, nil
+	case PolicyRequire:
+		return NTP{Servers: SplitServers(servers)}, nil
+	case PolicyFallback:
+		return Fallback{Trusted: NTP{Servers: SplitServers(servers)}}, nil
+	default:
+		return nil, fmt.Errorf("unknown time policy %q", policy)
+	}
+}
+
+// SplitServers splits a comma separated list of time servers
+func SplitServers(servers string) []string {
+	var result []string
+	for _, server := range strings.Split(servers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			result = append(result, server)
+		}
+	}
+
+	return result
+}
+
+// Local is the clock of this machine
+type Local struct{}
+
+func (Local) Now() (time.Time, error) {
+	return time.Now(), nil
+}
+
+func (Local) String() string {
+	return "the local clock"
+}
+
+// Fallback asks Trusted for the time, or the local clock if it fails
+type Fallback struct {
+	Trusted Source
+}
+
+func (f Fallback) Now() (time.Time, error) {
+	now, err := f.Trusted.Now()
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Could not get the time from %s (%v), falling back to the local clock.", f.Trusted, err))
+		return time.Now(), nil
+	}
+
+	return now, nil
+}
+
+func (f Fallback) String() string {
+	return fmt.Sprintf("%s, or the local clock", f.Trusted)
+}
@@ -0,0 +1,175 @@
+package clock
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer answers SNTP requests on 127.0.0.1 with a clock offset from the
+// local one. Answers do not echo the request when mismatched is set.
+func startServer(t *testing.T, offset time.Duration, mismatched bool) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		request := make([]byte, 512)
+		for {
+			size, peer, err := conn.ReadFrom(request)
+			if err != nil {
+				return
+			}
+			if size < ntpPacketSize {
+				continue
+			}
+
+			response := make([]byte, ntpPacketSize)
+			response[0] = 0<<6 | 4<<3 | 4 // server, version 4
+			response[1] = 2               // stratum
+			if !mismatched {
+				copy(response[24:32], request[40:48])
+			}
+
+			now := time.Now().Add(offset)
+			putNTPTime(response[32:40], now)
+			putNTPTime(response[40:48], now)
+
+			conn.WriteTo(response, peer)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// closedServer returns an address of 127.0.0.1 nothing answers on
+func closedServer(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	return address
+}
+
+func putNTPTime(b []byte, t time.Time) {
+	elapsed := t.Sub(ntpEpoch)
+	seconds := elapsed / time.Second
+	fraction := (uint64(elapsed%time.Second) << 32) / 1e9
+
+	binary.BigEndian.PutUint32(b, uint32(seconds))
+	binary.BigEndian.PutUint32(b[4:], uint32(fraction))
+}
+
+func TestPolicies(t *testing.T) {
+	const offset = time.Hour
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		server  func(t *testing.T) string
+		offset  time.Duration // expected offset from the local clock
+		wantErr bool
+	}{
+		{"require", PolicyRequire, func(t *testing.T) string { return startServer(t, offset, false) }, offset, false},
+		{"require without server", PolicyRequire, closedServer, 0, true},
+		{"require with mismatched answer", PolicyRequire, func(t *testing.T) string { return startServer(t, offset, true) }, 0, true},
+		{"fallback", PolicyFallback, func(t *testing.T) string { return startServer(t, offset, false) }, offset, false},
+		{"fallback without server", PolicyFallback, closedServer, 0, false},
+		{"local", PolicyLocal, func(t *testing.T) string { return startServer(t, offset, false) }, 0, false},
+		{"local without server", PolicyLocal, closedServer, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source, err := New(test.server(t), test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			now, err := source.Now()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("Now() = %s, want an error", now)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Now() failed: %v", err)
+			}
+
+			if drift := now.Sub(time.Now().Add(test.offset)).Abs(); drift > time.Second {
+				t.Errorf("Now() is %s off the expected time", drift)
+			}
+		})
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, name := range []string{"require", "fallback", "local"} {
+		if _, err := ParsePolicy(name); err != nil {
+			t.Errorf("ParsePolicy(%q) failed: %v", name, err)
+		}
+	}
+
+	if _, err := ParsePolicy("ntp"); err == nil {
+		t.Error("ParsePolicy(\"ntp\") succeeded, want an error")
+	}
+}
+
+func TestNTPAgreement(t *testing.T) {
+	const offset = time.Hour
+
+	honest := func(t *testing.T) string { return startServer(t, offset, false) }
+	liar := func(t *testing.T) string { return startServer(t, 5*offset, false) }
+
+	tests := []struct {
+		name    string
+		servers []func(t *testing.T) string
+		wantErr bool
+	}{
+		{"a liar outvoted", []func(t *testing.T) string{honest, liar, honest}, false},
+		{"a server down", []func(t *testing.T) string{honest, closedServer}, false},
+		{"no majority", []func(t *testing.T) string{honest, liar}, true},
+		{"every server down", []func(t *testing.T) string{closedServer, closedServer}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var servers []string
+			for _, server := range test.servers {
+				servers = append(servers, server(t))
+			}
+
+			source, err := New(strings.Join(servers, ", "), PolicyRequire)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			now, err := source.Now()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("Now() = %s, want an error", now)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Now() failed: %v", err)
+			}
+
+			if drift := now.Sub(time.Now().Add(offset)).Abs(); drift > time.Second {
+				t.Errorf("Now() is %s off the expected time", drift)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package clock
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ntpPacketSize     = 48
+	ntpDefaultPort    = "123"
+	ntpDefaultTimeout = 5 * time.Second
+)
+
+// ntpEpoch is the origin of NTP timestamps
+var ntpEpoch = time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// NTP asks NTP servers for the time with SNTP requests (RFC 4330). Every
+// address of every server is asked, up to ntpMaxAddresses each, and the time
+// is only trusted when most answers agree: a single wrong or lying server is
+// outvoted, the other answers do not have to wait for a server that is down.
+// SNTP answers are not authenticated, see the README.
+type NTP struct {
+	Servers []string // host or host:port, port 123 by default
+	Timeout time.Duration
+}
+
+const (
+	// ntpMaxAddresses is how many addresses of a server are asked,
+	// pool.ntp.org gives 4 servers of the pool
+	ntpMaxAddresses = 4
+
+	// ntpMaxSpread is how far from the median answer the agreeing answers can be
+	ntpMaxSpread = 10 * time.Second
+)
+
+func (n NTP) String() string {
+	if len(n.Servers) == 1 {
+		return "the time server " + n.Servers[0]
+	}
+
+	return "the time servers " + strings.Join(n.Servers, ", ")
+}
+
+func (n NTP) Now() (time.Time, error) {
+	timeout := n.Timeout
+	if timeout == 0 {
+		timeout = ntpDefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var addresses []string
+	var errs []error
+	for _, server := range n.Servers {
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = server, ntpDefaultPort
+		}
+
+		ips, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, ip := range ips[:min(len(ips), ntpMaxAddresses)] {
+			addresses = append(addresses, net.JoinHostPort(ip, port))
+		}
+	}
+
+	type answer struct {
+		offset time.Duration
+		err    error
+	}
+	answers := make(chan answer, len(addresses))
+	for _, address := range addresses {
+		go func() {
+			offset, err := ntpOffset(ctx, address)
+			answers <- answer{offset, err}
+		}()
+	}
+
+	var offsets []time.Duration
+	for range addresses {
+		a := <-answers
+		if a.err != nil {
+			errs = append(errs, a.err)
+			continue
+		}
+		offsets = append(offsets, a.offset)
+	}
+
+	if len(offsets) == 0 {
+		if len(errs) == 0 {
+			return time.Time{}, errors.New("no time server is given")
+		}
+		return time.Time{}, errors.Join(errs...)
+	}
+
+	slices.Sort(offsets)
+	median := offsets[len(offsets)/2]
+
+	agreeing := 0
+	for _, offset := range offsets {
+		if (offset - median).Abs() <= ntpMaxSpread {
+			agreeing++
+		}
+	}
+	if agreeing*2 <= len(offsets) {
+		return time.Time{}, fmt.Errorf("the %d answers of %s do not agree on the time", len(offsets), n)
+	}
+
+	return time.Now().Add(median), nil
+}
+
+// ntpOffset asks the NTP server at address how far the local clock is from its own
+func ntpOffset(ctx context.Context, address string) (time.Duration, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+
+	// Client request, version 4. The transmit timestamp is random, the server
+	// echoes it back so answers that do not belong to this request are rejected.
+	request := make([]byte, ntpPacketSize)
+	request[0] = 0<<6 | 4<<3 | 3
+	if _, err := rand.Read(request[40:48]); err != nil {
+		return 0, err
+	}
+
+	sent := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+
+	response := make([]byte, 512)
+	size, err := conn.Read(response)
+	if err != nil {
+		return 0, err
+	}
+	received := time.Now()
+	response = response[:size]
+
+	if err := validateNTPResponse(request, response); err != nil {
+		return 0, fmt.Errorf("invalid answer from %s: %w", address, err)
+	}
+
+	serverReceived := ntpTime(response[32:40])
+	serverSent := ntpTime(response[40:48])
+
+	// Clock offset as defined by RFC 4330, it cancels out the network delay
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+func validateNTPResponse(request, response []byte) error {
+	if len(response) < ntpPacketSize {
+		return errors.New("short packet")
+	}
+
+	if mode := response[0] & 0x7; mode != 4 {
+		return fmt.Errorf("unexpected mode %d", mode)
+	}
+
+	if leap := response[0] >> 6; leap == 3 {
+		return errors.New("server clock is not synchronized")
+	}
+
+	if stratum := response[1]; stratum == 0 || stratum > 15 {
+		return fmt.Errorf("server refused the request (stratum %d)", stratum)
+	}
+
+	if !bytes.Equal(response[24:32], request[40:48]) {
+		return errors.New("answer does not match the request")
+	}
+
+	return nil
+}
+
+// ntpTime converts a 64 bit NTP timestamp. Timestamps below 2^31 seconds are
+// taken to be in era 1, so the conversion is correct from 1968 to 2104.
+func ntpTime(b []byte) time.Time {
+	seconds := uint64(binary.BigEndian.Uint32(b))
+	fraction := uint64(binary.BigEndian.Uint32(b[4:]))
+
+	if seconds < 1<<31 {
+		seconds += 1 << 32
+	}
+
+	nanoseconds := (fraction * 1e9) >> 32
+
+	return ntpEpoch.Add(time.Duration(seconds) * time.Second).Add(time.Duration(nanoseconds))
+}
@@ -0,0 +1,123 @@
+package grader
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ahmedYasserM/qo/pkg/logger"
+	"github.com/ahmedYasserM/qo/pkg/manifest"
+	"github.com/ahmedYasserM/qo/pkg/sandbox"
+	"github.com/ahmedYasserM/qo/pkg/session"
+)
+
+// Grade runs the check script of every level of the challenge inside the
+// sandbox and records the results in the bundle. Levels are taken from the
+// check scripts kept in sandbox.ChecksDir, not from what the student left in
+// the rootfs. When the challenge has a manifest, levels are graded in its
+// order, with its points and check timeouts, and levels whose dependencies
+// did not pass are skipped. cfg.Timeout is the timeout of the levels the
+// manifest gives none.
+func Grade(bundle *session.Bundle, challenge string, cfg sandbox.CheckConfig) error {
+	levels, err := Levels(challenge)
+	if err != nil {
+		return err
+	}
+
+	challengeManifest, err := manifest.Load(filepath.Join(sandbox.ChecksDir, challenge))
+	if err != nil {
+		return err
+	}
+
+	levels = challengeManifest.Order(levels)
+	if challengeManifest != nil {
+		bundle.Session.Title = challengeManifest.Title
+		bundle.Session.MaxPoints = challengeManifest.MaxPoints()
+	}
+
+	passed := make(map[string]bool)
+	for _, level := range levels {
+		declared, _ := challengeManifest.Level(level)
+
+		levelResult := session.LevelResult{
+			Level:     level,
+			Title:     declared.Title,
+			MaxPoints: declared.Points,
+		}
+
+		for _, dependency := range declared.DependsOn {
+			if !passed[dependency] {
+				levelResult.SkippedFor = append(levelResult.SkippedFor, dependency)
+			}
+		}
+
+		if len(levelResult.SkippedFor) > 0 {
+			logger.Warn(fmt.Sprintf("%s skipped: %s did not pass.", level, strings.Join(levelResult.SkippedFor, ", ")))
+
+			if err := bundle.AddLevel(levelResult, nil, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		levelCfg := cfg
+		levelCfg.Timeout = challengeManifest.CheckTimeout(level, cfg.Timeout)
+
+		result, err := sandbox.RunCheck(CheckScript(challenge, level), levelCfg)
+		if err != nil {
+			return err
+		}
+
+		levelResult.Passed = result.Passed()
+		levelResult.ExitCode = result.ExitCode
+		levelResult.TimedOut = result.TimedOut
+		levelResult.Duration = result.Duration
+
+		switch {
+		case levelResult.Passed:
+			passed[level] = true
+			levelResult.Points = declared.Points
+			logger.Success(fmt.Sprintf("%s passed.", level))
+		case result.TimedOut:
+			logger.Warn(fmt.Sprintf("%s failed: check.sh did not finish within %s.", level, levelCfg.Timeout))
+		default:
+			logger.Warn(fmt.Sprintf("%s failed: check.sh exited with status %d.", level, result.ExitCode))
+		}
+
+		if err := bundle.AddLevel(levelResult, result.Stdout, result.Stderr); err != nil {
+			return err
+		}
+	}
+
+	if bundle.Session.MaxPoints > 0 {
+		logger.Info(fmt.Sprintf("%d/%d levels passed, %d/%d points.", len(passed), len(bundle.Session.Levels), bundle.Session.Points, bundle.Session.MaxPoints))
+	} else {
+		logger.Info(fmt.Sprintf("%d/%d levels passed.", len(passed), len(bundle.Session.Levels)))
+	}
+
+	return nil
+}
+
+// Levels returns the levels of the challenge extracted in the sandbox, from
+// the check scripts kept in sandbox.ChecksDir
+func Levels(challenge string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(sandbox.ChecksDir, challenge))
+	if err != nil {
+		return nil, err
+	}
+
+	var levels []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			levels = append(levels, entry.Name())
+		}
+	}
+
+	return levels, nil
+}
+
+// CheckScript returns the path of the check script of a level
+func CheckScript(challenge, level string) string {
+	return filepath.Join(sandbox.ChecksDir, challenge, level, "check.sh")
+}
@@ -0,0 +1,277 @@
+package keys
+
+// Keys are stored in PEM files: private keys as PKCS #8 ("PRIVATE KEY") and
+// public keys as PKIX ("PUBLIC KEY"), the formats openssl uses too.
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	privateKeyType = "PRIVATE KEY"
+	publicKeyType  = "PUBLIC KEY"
+)
+
+// GenerateSigningKey creates an Ed25519 key pair for signing archives. The
+// private key is written to privatePath and the public key to publicPath,
+// existing files are never overwritten.
+func GenerateSigningKey(privatePath, publicPath string) (ed25519.PublicKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writePair(privatePath, publicPath, private, public); err != nil {
+		return nil, err
+	}
+
+	return public, nil
+}
+
+// ReadSigningKey reads an Ed25519 private key from a PEM file
+func ReadSigningKey(path string) (ed25519.PrivateKey, error) {
+	key, err := readPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", path)
+	}
+
+	return signingKey, nil
+}
+
+// ReadVerifyKey reads an Ed25519 public key from a PEM file
+func ReadVerifyKey(path string) (ed25519.PublicKey, error) {
+	key, err := readPublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	verifyKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 public key", path)
+	}
+
+	return verifyKey, nil
+}
+
+// ParseVerifyKey decodes an Ed25519 public key given as the base64 of its
+// PKIX encoding, the body of the PEM file on a single line.
+func ParseVerifyKey(encoded string) (ed25519.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	verifyKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("invalid public key: not an Ed25519 key")
+	}
+
+	return verifyKey, nil
+}
+
+// GenerateIdentity creates an X25519 key pair a student decrypts archives
+// built for them with. Files are written like GenerateSigningKey does.
+func GenerateIdentity(privatePath, publicPath string) (*ecdh.PublicKey, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writePair(privatePath, publicPath, private, private.PublicKey()); err != nil {
+		return nil, err
+	}
+
+	return private.PublicKey(), nil
+}
+
+// ReadIdentity reads an X25519 private key from a PEM file
+func ReadIdentity(path string) (*ecdh.PrivateKey, error) {
+	key, err := readPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, ok := key.(*ecdh.PrivateKey)
+	if !ok || identity.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%s: not an X25519 private key", path)
+	}
+
+	return identity, nil
+}
+
+// ReadRecipient reads an X25519 public key from a PEM file
+func ReadRecipient(path string) (*ecdh.PublicKey, error) {
+	key, err := readPublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	recipient, ok := key.(*ecdh.PublicKey)
+	if !ok || recipient.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%s: not an X25519 public key", path)
+	}
+
+	return recipient, nil
+}
+
+// ReadRoster reads the public keys of a class. Every line holds a student id
+// and the student's public key as printed by EncodePublicKey; empty lines and
+// lines starting with # are skipped.
+func ReadRoster(path string) ([]*ecdh.PublicKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var recipients []*ecdh.PublicKey
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<student id> <public key>\"", path, line)
+		}
+
+		recipient, err := parseRecipient(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: student %s: %w", path, line, fields[0], err)
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return recipients, nil
+}
+
+func parseRecipient(encoded string) (*ecdh.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	recipient, ok := key.(*ecdh.PublicKey)
+	if !ok || recipient.Curve() != ecdh.X25519() {
+		return nil, errors.New("invalid public key: not an X25519 key")
+	}
+
+	return recipient, nil
+}
+
+// EncodePublicKey returns the base64 of the PKIX encoding of key, as read by
+// ParseVerifyKey and found in rosters
+func EncodePublicKey(key any) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+func writePair(privatePath, publicPath string, private, public any) error {
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(privatePath, privateKeyType, privateDER, 0600); err != nil {
+		return err
+	}
+
+	return writePEM(publicPath, publicKeyType, publicDER, 0644)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s: no %s PEM block found", path, blockType)
+	}
+
+	return block.Bytes, nil
+}
+
+func readPrivateKey(path string) (any, error) {
+	der, err := readPEM(path, privateKeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return key, nil
+}
+
+func readPublicKey(path string) (any, error) {
+	der, err := readPEM(path, publicKeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return key, nil
+}
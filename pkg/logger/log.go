@@ -1,38 +1,92 @@
 package logger
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sync/atomic"
 )
 
 var (
-	infoLogger    = log.New(os.Stdout, "\033[36mℹ️\033[0m ", 0)
-	warnLogger    = log.New(os.Stdout, "\033[33m⚠️\033[0m ", 0)
-	errorLogger   = log.New(os.Stderr, "\033[31m❌\033[0m ", 0)
-	successLogger = log.New(os.Stdout, "\033[32m✅\033[0m ", 0)
+	infoLogger    = log.New(terminalWriter{os.Stdout}, "\033[36mℹ️\033[0m ", 0)
+	warnLogger    = log.New(terminalWriter{os.Stdout}, "\033[33m⚠️\033[0m ", 0)
+	errorLogger   = log.New(terminalWriter{os.Stderr}, "\033[31m❌\033[0m ", 0)
+	successLogger = log.New(terminalWriter{os.Stdout}, "\033[32m✅\033[0m ", 0)
+
+	// rawTerminal is set while the terminal is in raw mode and does not translate line feeds
+	rawTerminal atomic.Bool
+
+	// captureLogger mirrors all messages without colors, nil when capturing is off
+	captureLogger *log.Logger
 )
 
+// terminalWriter starts messages on a new line and ends them with a carriage
+// return while the terminal is in raw mode.
+type terminalWriter struct {
+	w io.Writer
+}
+
+func (t terminalWriter) Write(p []byte) (int, error) {
+	if !rawTerminal.Load() {
+		return t.w.Write(p)
+	}
+
+	line := append([]byte("\r\n"), bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))...)
+	if _, err := t.w.Write(line); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// SetRawTerminal tells the logger whether the terminal is in raw mode
+func SetRawTerminal(raw bool) {
+	rawTerminal.Store(raw)
+}
+
+// Capture mirrors every following message to w as plain timestamped lines.
+// Passing nil stops capturing.
+func Capture(w io.Writer) {
+	if w == nil {
+		captureLogger = nil
+		return
+	}
+
+	captureLogger = log.New(w, "", log.LstdFlags)
+}
+
+func capture(level, msg string) {
+	if captureLogger != nil {
+		captureLogger.Printf("%-7s %s", level, msg)
+	}
+}
+
 // Info logs an informational message
 func Info(msg string) {
 	coloredMsg := fmt.Sprintf("\033[36m%s\033[0m", msg) // Cyan
 	infoLogger.Println(coloredMsg)
+	capture("INFO", msg)
 }
 
 // Warn logs a warning message
 func Warn(msg string) {
 	coloredMsg := fmt.Sprintf("\033[33m%s\033[0m", msg) // Yellow
 	warnLogger.Println(coloredMsg)
+	capture("WARN", msg)
 }
 
 // Error logs an error
 func Error(err error) {
 	coloredMsg := fmt.Sprintf("\033[31m%s\033[0m", err.Error()) // Red
 	errorLogger.Println(coloredMsg)
+	capture("ERROR", err.Error())
 }
 
 // Success logs a success message
 func Success(msg string) {
 	coloredMsg := fmt.Sprintf("\033[32m%s\033[0m", msg) // Green
 	successLogger.Println(coloredMsg)
+	capture("SUCCESS", msg)
 }
@@ -0,0 +1,254 @@
+package manifest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/ahmedYasserM/qo/pkg/sandbox"
+	"gopkg.in/yaml.v3"
+)
+
+// FileName is the optional manifest at the root of a challenge folder.
+//
+// Example:
+//
+//	title: Linux basics
+//	network: loopback
+//	limits:
+//	  pids_max: 256
+//	  memory_max: 512M
+//	  cpu_max: 1.5
+//	levels:
+//	  - name: level1
+//	    title: Create a directory
+//	    points: 10
+//	    requires: [mkdir]
+//	  - name: level2
+//	    title: Copy a secret
+//	    points: 20
+//	    depends_on: [level1]
+//	    check_timeout: 10s
+const FileName = "challenge.yaml"
+
+// Manifest declares the levels of a challenge, in the order they are graded
+type Manifest struct {
+	Title string `yaml:"title,omitempty"`
+
+	// Network is what the sandbox is connected to, see sandbox.Network
+	Network sandbox.Network `yaml:"network,omitempty"`
+
+	// Namespaces the sandbox is isolated in, every namespace when empty
+	Namespaces []string `yaml:"namespaces,omitempty"`
+
+	// Limits are the default resource limits of the sandbox, qo start flags replace them
+	Limits Limits `yaml:"limits,omitempty"`
+
+	Levels []Level `yaml:"levels"`
+}
+
+// Limits declares the cgroup limits of the sandbox, see sandbox.Limits
+type Limits struct {
+	PidsMax int64 `yaml:"pids_max,omitempty"`
+
+	// MemoryMax is a size like 512M or 2G
+	MemoryMax string `yaml:"memory_max,omitempty"`
+
+	// CPUMax is a number of CPUs, like 0.5 or 2
+	CPUMax float64 `yaml:"cpu_max,omitempty"`
+}
+
+// Sandbox converts the limits to the sandbox limits
+func (l Limits) Sandbox() (sandbox.Limits, error) {
+	memory, err := sandbox.ParseSize(l.MemoryMax)
+	if err != nil {
+		return sandbox.Limits{}, fmt.Errorf("memory_max: %w", err)
+	}
+
+	limits := sandbox.Limits{PidsMax: l.PidsMax, MemoryMax: memory, CPUMax: l.CPUMax}
+	if err := limits.Validate(); err != nil {
+		return sandbox.Limits{}, err
+	}
+
+	return limits, nil
+}
+
+// Level describes one level folder of the challenge
+type Level struct {
+	Name  string `yaml:"name"`
+	Title string `yaml:"title,omitempty"`
+
+	// Points are earned when the level passes
+	Points int `yaml:"points,omitempty"`
+
+	// DependsOn lists levels that have to pass for this one to be graded
+	DependsOn []string `yaml:"depends_on,omitempty"`
+
+	// Requires lists binaries that have to be in the sandbox rootfs
+	Requires []string `yaml:"requires,omitempty"`
+
+	// CheckTimeout replaces the check timeout of qo start for this level
+	CheckTimeout time.Duration `yaml:"check_timeout,omitempty"`
+}
+
+// Parse decodes a manifest, unknown fields are rejected to catch typos
+func Parse(data []byte) (*Manifest, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var m Manifest
+	if err := decoder.Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", FileName, err)
+	}
+
+	return &m, nil
+}
+
+// Load reads the manifest of the challenge folder dir. It returns nil when
+// the challenge has no manifest.
+func Load(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// Level returns the level called name. A nil manifest declares no level.
+func (m *Manifest) Level(name string) (Level, bool) {
+	if m == nil {
+		return Level{}, false
+	}
+
+	for _, level := range m.Levels {
+		if level.Name == name {
+			return level, true
+		}
+	}
+
+	return Level{}, false
+}
+
+// Order returns the level folders in the order of the manifest
+func (m *Manifest) Order(folders []string) []string {
+	if m == nil {
+		return folders
+	}
+
+	ordered := make([]string, 0, len(folders))
+	for _, level := range m.Levels {
+		if slices.Contains(folders, level.Name) {
+			ordered = append(ordered, level.Name)
+		}
+	}
+
+	for _, folder := range folders {
+		if !slices.Contains(ordered, folder) {
+			ordered = append(ordered, folder)
+		}
+	}
+
+	return ordered
+}
+
+// CheckTimeout returns the check timeout of a level, fallback when it does not declare one
+func (m *Manifest) CheckTimeout(name string, fallback time.Duration) time.Duration {
+	if level, ok := m.Level(name); ok && level.CheckTimeout > 0 {
+		return level.CheckTimeout
+	}
+
+	return fallback
+}
+
+// MaxPoints is the score of a student passing every level
+func (m *Manifest) MaxPoints() int {
+	total := 0
+	for _, level := range m.Levels {
+		total += level.Points
+	}
+
+	return total
+}
+
+// Validate checks the manifest against the level folders of the challenge.
+// hasBinary tells whether a binary is available in the sandbox rootfs. All
+// problems are reported at once.
+func (m *Manifest) Validate(folders []string, hasBinary func(name string) bool) error {
+	var errs []error
+
+	if len(m.Levels) == 0 {
+		errs = append(errs, fmt.Errorf("%s declares no levels", FileName))
+	}
+
+	network, err := sandbox.ParseNetwork(string(m.Network))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", FileName, err))
+	}
+
+	namespaces, err := sandbox.ParseNamespaces(m.Namespaces)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", FileName, err))
+	} else if network == sandbox.NetworkVeth && !slices.Contains(namespaces, sandbox.NamespaceNet) {
+		errs = append(errs, fmt.Errorf("%s: the %s network needs the %s namespace", FileName, sandbox.NetworkVeth, sandbox.NamespaceNet))
+	}
+
+	if _, err := m.Limits.Sandbox(); err != nil {
+		errs = append(errs, fmt.Errorf("%s: limits: %w", FileName, err))
+	}
+
+	seen := make(map[string]bool)
+	for i, level := range m.Levels {
+		name := level.Name
+		if name == "" {
+			errs = append(errs, fmt.Errorf("%s: level %d has no name", FileName, i+1))
+			continue
+		}
+
+		if seen[name] {
+			errs = append(errs, fmt.Errorf("%s: level %q is declared twice", FileName, name))
+		}
+
+		if !slices.Contains(folders, name) {
+			errs = append(errs, fmt.Errorf("%s: level %q has no folder", FileName, name))
+		}
+
+		if level.Points < 0 {
+			errs = append(errs, fmt.Errorf("%s: level %q has negative points", FileName, name))
+		}
+
+		if level.CheckTimeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: level %q has a negative check timeout", FileName, name))
+		}
+
+		// Dependencies have to be declared before, which also rules out cycles
+		for _, dependency := range level.DependsOn {
+			if !seen[dependency] {
+				errs = append(errs, fmt.Errorf("%s: level %q depends on %q, which is not declared before it", FileName, name, dependency))
+			}
+		}
+
+		for _, binary := range level.Requires {
+			if !hasBinary(binary) {
+				errs = append(errs, fmt.Errorf("%s: level %q requires %q, which is not in the sandbox rootfs", FileName, name, binary))
+			}
+		}
+
+		seen[name] = true
+	}
+
+	for _, folder := range folders {
+		if !seen[folder] {
+			errs = append(errs, fmt.Errorf("%s: level folder %q is not declared", FileName, folder))
+		}
+	}
+
+	return errors.Join(errs...)
+}
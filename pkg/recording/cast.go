@@ -0,0 +1,140 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// header is the first line of an asciicast v2 file
+type header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Cast records a terminal session in the asciicast v2 format, which can be
+// replayed with `asciinema play`.
+//
+// See https://docs.asciinema.org/manual/asciicast/v2/
+type Cast struct {
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	start  time.Time
+	input  []byte // incomplete UTF-8 sequence left from the last input
+	output []byte // incomplete UTF-8 sequence left from the last output
+}
+
+// Create starts a new recording at path for a terminal of the given size.
+func Create(path, title string, width, height int) (*Cast, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cast{
+		file:  file,
+		w:     bufio.NewWriter(file),
+		start: time.Now(),
+	}
+
+	data, err := json.Marshal(header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: c.start.Unix(),
+		Title:     title,
+		Env: map[string]string{
+			"SHELL": "/bin/bash",
+			"TERM":  os.Getenv("TERM"),
+		},
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if _, err := c.w.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Input records keystrokes sent to the terminal
+func (c *Cast) Input(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.input = c.event("i", c.input, p)
+}
+
+// Output records what the terminal printed
+func (c *Cast) Output(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.output = c.event("o", c.output, p)
+}
+
+// Resize records a change of the terminal size
+func (c *Cast) Resize(width, height int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.write("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+// Close flushes the recording to disk
+func (c *Cast) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.w.Flush(); err != nil {
+		c.file.Close()
+		return err
+	}
+
+	return c.file.Close()
+}
+
+// event records the complete UTF-8 part of pending+p and returns the
+// incomplete rest, which is completed by the next read of the same stream.
+func (c *Cast) event(code string, pending, p []byte) []byte {
+	data := append(pending, p...)
+
+	end := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+
+	if end > 0 {
+		c.write(code, string(data[:end]))
+	}
+
+	return append([]byte(nil), data[end:]...)
+}
+
+// write appends a single [time, code, data] event line
+func (c *Cast) write(code, data string) {
+	line, err := json.Marshal([]any{time.Since(c.start).Seconds(), code, data})
+	if err != nil {
+		return
+	}
+
+	c.w.Write(append(line, '\n'))
+}
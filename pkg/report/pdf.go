@@ -0,0 +1,125 @@
+package report
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A4 page size in points
+const (
+	pageWidth  = 595.0
+	pageHeight = 842.0
+)
+
+// Fonts of the standard 14 set, available in every PDF reader without embedding
+var fonts = []struct {
+	name     string
+	baseFont string
+}{
+	{"F1", "Helvetica"},
+	{"F2", "Helvetica-Bold"},
+	{"F3", "Courier"},
+}
+
+const (
+	regular = "F1"
+	bold    = "F2"
+	mono    = "F3"
+)
+
+type color struct {
+	r, g, b float64
+}
+
+var (
+	black = color{0, 0, 0}
+	gray  = color{0.45, 0.45, 0.45}
+	green = color{0.1, 0.5, 0.2}
+	red   = color{0.75, 0.1, 0.1}
+)
+
+// page is the content stream of a single page PDF document
+type page struct {
+	content bytes.Buffer
+}
+
+// text draws s with its baseline starting at x, y
+func (p *page) text(font string, size, x, y float64, c color, s string) {
+	fmt.Fprintf(&p.content, "BT %.3g %.3g %.3g rg /%s %.4g Tf %.4g %.4g Td (%s) Tj ET\n",
+		c.r, c.g, c.b, font, size, x, y, escape(s))
+}
+
+// line draws a horizontal line from x1 to x2
+func (p *page) line(x1, x2, y float64) {
+	fmt.Fprintf(&p.content, "0.75 G 0.5 w %.4g %.4g m %.4g %.4g l S\n", x1, y, x2, y)
+}
+
+// escape encodes s in WinAnsiEncoding as a PDF literal string, characters
+// outside of it are replaced with '?'.
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("    ")
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff: // Latin-1 matches WinAnsi in this range
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+
+	return b.String()
+}
+
+// write outputs the page as a complete PDF document
+func (p *page) write(w io.Writer, title string) error {
+	var objects []string
+
+	objects = append(objects, "<< /Type /Catalog /Pages 2 0 R >>")
+	objects = append(objects, "<< /Type /Pages /Kids [3 0 R] /Count 1 >>")
+
+	var fontRefs strings.Builder
+	for i, f := range fonts {
+		fmt.Fprintf(&fontRefs, "/%s %d 0 R ", f.name, 4+i)
+	}
+	contentRef := 4 + len(fonts)
+
+	objects = append(objects, fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %g %g] /Resources << /Font << %s>> >> /Contents %d 0 R >>",
+		pageWidth, pageHeight, fontRefs.String(), contentRef))
+
+	for _, f := range fonts {
+		objects = append(objects, fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", f.baseFont))
+	}
+
+	objects = append(objects, fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.String()))
+	objects = append(objects, fmt.Sprintf("<< /Title (%s) /Producer (qo) >>", escape(title)))
+	infoRef := len(objects)
+
+	var doc bytes.Buffer
+	doc.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = doc.Len()
+		fmt.Fprintf(&doc, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := doc.Len()
+	fmt.Fprintf(&doc, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&doc, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&doc, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, infoRef, xref)
+
+	_, err := w.Write(doc.Bytes())
+
+	return err
+}
@@ -0,0 +1,223 @@
+package report
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ahmedYasserM/qo/pkg/sandbox"
+	"github.com/ahmedYasserM/qo/pkg/session"
+)
+
+const (
+	margin       = 50.0
+	bottomMargin = 60.0
+	valueColumn  = 170.0
+
+	// Level names and titles longer than this are cut so they do not run into the status column
+	nameWidth = 42
+
+	// Check output lines longer than this are cut in the report
+	excerptWidth = 95
+	// Maximum number of check output lines shown per level
+	maxExcerptLines = 4
+)
+
+var exitReasons = map[string]string{
+	"shell-exited": "The student closed the shell",
+	"time-expired": "The test duration ran out",
+	"error":        "The session failed",
+}
+
+// Generate renders the single page evaluation report of a finished session
+// into report.pdf in the results bundle.
+func Generate(bundle *session.Bundle) error {
+	s := &bundle.Session
+	p := &page{}
+	y := pageHeight - 60
+
+	p.text(bold, 20, margin, y, black, "qo Evaluation Report")
+	y -= 18
+	p.text(regular, 9, margin, y, gray, "Generated on "+time.Now().Format("2006-01-02 15:04 MST"))
+	y -= 14
+	p.line(margin, pageWidth-margin, y)
+	y -= 22
+
+	reason := exitReasons[s.ExitReason]
+	if reason == "" {
+		reason = s.ExitReason
+	}
+
+	details := [][2]string{
+		{"Student ID", fmt.Sprint(s.StudentID)},
+	}
+	if s.Title != "" {
+		details = append(details, [2]string{"Challenge", s.Title})
+	}
+	details = append(details, [][2]string{
+		{"Archive", s.Archive},
+		{"Started", s.StartedAt.Format("2006-01-02 15:04:05 MST")},
+		{"Ended", s.EndedAt.Format("2006-01-02 15:04:05 MST")},
+		{"Time spent", s.EndedAt.Sub(s.StartedAt).Round(time.Second).String()},
+		{"Session end", reason},
+	}...)
+	if s.Error != "" {
+		details = append(details, [2]string{"Error", s.Error})
+	}
+	if s.Limits != nil {
+		details = append(details, [2]string{"Limits", limitSummary(s.Limits)})
+	}
+
+	for _, detail := range details {
+		p.text(bold, 10, margin, y, black, detail[0])
+		p.text(regular, 10, valueColumn, y, black, detail[1])
+		y -= 15
+	}
+	p.text(bold, 10, margin, y, black, "Archive SHA-256")
+	p.text(mono, 8, valueColumn, y, gray, s.ArchiveSHA256)
+	y -= 12
+	p.line(margin, pageWidth-margin, y)
+	y -= 22
+
+	passed := 0
+	for _, level := range s.Levels {
+		if level.Passed {
+			passed++
+		}
+	}
+
+	p.text(bold, 10, margin, y, black, "Score")
+	score := fmt.Sprintf("%d / %d levels passed", passed, len(s.Levels))
+	if s.MaxPoints > 0 {
+		score = fmt.Sprintf("%d / %d points, %s", s.Points, s.MaxPoints, score)
+	}
+	p.text(bold, 10, valueColumn, y, black, score)
+	y -= 15
+	p.text(bold, 10, margin, y, black, "Commands")
+	p.text(regular, 10, valueColumn, y, black, fmt.Sprintf("%d executed, %d failed", s.CommandCount, s.FailedCommandCount))
+	y -= 12
+	p.line(margin, pageWidth-margin, y)
+	y -= 24
+
+	p.text(bold, 14, margin, y, black, "Levels")
+	y -= 20
+
+	// Share the rest of the page between the levels so the report stays on one page
+	levelHeight := 20.0
+	excerptLines := 0
+	if len(s.Levels) > 0 {
+		perLevel := (y - bottomMargin) / float64(len(s.Levels))
+		excerptLines = min(max(int((perLevel-levelHeight)/10), 0), maxExcerptLines)
+	}
+
+	for i, level := range s.Levels {
+		if y-levelHeight < bottomMargin {
+			p.text(regular, 9, margin, y, gray, fmt.Sprintf("... %d more levels, see session.json", len(s.Levels)-i))
+			break
+		}
+
+		status, statusColor := "PASS", green
+		switch {
+		case len(level.SkippedFor) > 0:
+			status, statusColor = "SKIPPED", gray
+		case level.TimedOut:
+			status, statusColor = "TIMEOUT", red
+		case !level.Passed:
+			status, statusColor = "FAIL", red
+		}
+
+		name := level.Level
+		if level.Title != "" {
+			name += " - " + level.Title
+		}
+		if len(name) > nameWidth {
+			name = name[:nameWidth-3] + "..."
+		}
+
+		result := fmt.Sprintf("exit %d, %s", level.ExitCode, level.Duration.Round(time.Millisecond))
+		if len(level.SkippedFor) > 0 {
+			result = "needs " + strings.Join(level.SkippedFor, ", ")
+		}
+		if level.MaxPoints > 0 {
+			result = fmt.Sprintf("%d / %d pts, %s", level.Points, level.MaxPoints, result)
+		}
+
+		p.text(bold, 11, margin, y, black, name)
+		p.text(bold, 11, 330, y, statusColor, status)
+		p.text(regular, 9, 400, y, gray, result)
+		y -= 13
+
+		for _, line := range excerpt(bundle.Dir, level, excerptLines) {
+			p.text(mono, 8, margin+12, y, gray, line)
+			y -= 10
+		}
+		y -= 7
+	}
+
+	p.text(regular, 8, margin, 35, gray, "The full check outputs, terminal recording and command log are in the session folder.")
+
+	file, err := os.Create(filepath.Join(bundle.Dir, "report.pdf"))
+	if err != nil {
+		return err
+	}
+
+	if err := p.write(file, fmt.Sprintf("qo report - student %d", s.StudentID)); err != nil {
+		file.Close()
+		return err
+	}
+
+	s.Report = "report.pdf"
+
+	return file.Close()
+}
+
+// excerpt returns the first non-empty lines printed by the check script of a level
+func excerpt(dir string, level session.LevelResult, limit int) []string {
+	var lines []string
+
+	for _, name := range []string{level.StdoutFile, level.StderrFile} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			if len(lines) == limit {
+				return lines
+			}
+			if len(line) > excerptWidth {
+				line = line[:excerptWidth-3] + "..."
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// limitSummary describes the limits of the sandbox and how often the student ran into them
+func limitSummary(report *sandbox.LimitReport) string {
+	summary := report.Limits.String()
+
+	var events []string
+	if report.OOMKills > 0 {
+		events = append(events, fmt.Sprintf("%d killed out of memory", report.OOMKills))
+	}
+	if report.PidsMaxRefused > 0 {
+		events = append(events, fmt.Sprintf("%d forks refused", report.PidsMaxRefused))
+	}
+	if report.MemoryMaxHits > 0 && report.OOMKills == 0 {
+		events = append(events, fmt.Sprintf("memory limit hit %d times", report.MemoryMaxHits))
+	}
+	if len(events) == 0 {
+		return summary + ", never reached"
+	}
+
+	return summary + " (" + strings.Join(events, ", ") + ")"
+}
@@ -0,0 +1,110 @@
+package sandbox
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/ahmedYasserM/qo/pkg/audit"
+)
+
+// auditFd is the file descriptor, inherited from qo, the init process forwards
+// the command records to
+const auditFd = 3
+
+// auditTimeout is how long the records are still forwarded after the shell
+// exits, while background processes of the student hold the pipe of the hook
+const auditTimeout = time.Second
+
+// auditor forwards the records of the shell hook from its pipe to qo
+type auditor struct {
+	reader *os.File
+	writer *os.File // inherited by the shell as audit.HookFd
+	done   chan struct{}
+}
+
+// startAudit installs the shell hook in the sandbox and creates its pipe. It
+// must be called inside the rootfs before dropToUser, so the hook stays owned
+// by root. Nothing in the sandbox can open the pipe by path, only the shell
+// and the processes it starts inherit it.
+func startAudit() (*auditor, error) {
+	out := os.NewFile(auditFd, "audit")
+
+	// The student's shell must not be able to write to qo directly
+	syscall.CloseOnExec(auditFd)
+
+	if err := os.MkdirAll(filepath.Dir(audit.HookPath), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(audit.HookPath, audit.Hook, 0644); err != nil {
+		return nil, err
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &auditor{reader: reader, writer: writer, done: make(chan struct{})}
+
+	go func() {
+		io.Copy(out, reader)
+		out.Close()
+		close(a.done)
+	}()
+
+	return a, nil
+}
+
+// attach hands the write end of the pipe to the shell
+func (a *auditor) attach(cmd *exec.Cmd) {
+	cmd.ExtraFiles = []*os.File{a.writer} // audit.HookFd in the shell
+}
+
+// stop waits until every record written by the shell is forwarded. Records
+// of processes outliving the shell are dropped after auditTimeout.
+func (a *auditor) stop() {
+	a.writer.Close()
+
+	select {
+	case <-a.done:
+	case <-time.After(auditTimeout):
+		a.reader.Close()
+		<-a.done
+	}
+}
+
+// collectCommands decodes the records forwarded by the init process into log
+// until the init process exits. A nil log discards them. Records not written
+// by the hook are skipped and counted, and reading goes on until the end even
+// when the log fails, so the init process is never blocked. An audit problem
+// must not end the session.
+func collectCommands(r io.Reader, log *audit.Log) (skipped int, err error) {
+	reader := audit.NewReader(r)
+
+	for {
+		record, readErr := reader.Read()
+		if readErr == io.EOF {
+			return skipped, err
+		}
+		if errors.Is(readErr, audit.ErrInvalidRecord) {
+			skipped++
+			continue
+		}
+		if readErr != nil {
+			io.Copy(io.Discard, r)
+			return skipped, readErr
+		}
+
+		if log == nil || err != nil {
+			continue
+		}
+
+		err = log.Add(record)
+	}
+}
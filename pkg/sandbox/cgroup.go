@@ -0,0 +1,478 @@
+package sandbox
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ahmedYasserM/qo/pkg/logger"
+)
+
+// Where the cgroup v2 hierarchy is mounted, and the cgroup of qo in it
+const (
+	mountinfoPath  = "/proc/self/mountinfo"
+	procCgroupPath = "/proc/self/cgroup"
+)
+
+// cpuPeriod is the cpu.max period, in microseconds
+const cpuPeriod = 100000
+
+// Bounds of the CPU limit: the kernel refuses cpu.max quotas under 1ms, or
+// above about 2^44µs
+const (
+	minCPU = 1000.0 / cpuPeriod
+	maxCPU = float64(1<<44-1) / cpuPeriod
+)
+
+// Limits are the cgroup v2 resource limits of a session, zero values are unlimited
+type Limits struct {
+	PidsMax   int64   `json:"pids_max,omitempty"`
+	MemoryMax int64   `json:"memory_max,omitempty"` // bytes
+	CPUMax    float64 `json:"cpu_max,omitempty"`    // CPUs the sandbox can keep busy
+}
+
+// LimitReport is what the cgroup of a session enforced, and how often the
+// sandbox ran into it
+type LimitReport struct {
+	Limits         Limits `json:"limits"`
+	OOMKills       int64  `json:"oom_kills"`        // processes killed for using more than memory.max
+	MemoryMaxHits  int64  `json:"memory_max_hits"`  // times the memory usage hit memory.max
+	PidsMaxRefused int64  `json:"pids_max_refused"` // forks refused by pids.max
+}
+
+// IsZero tells whether no limit is set
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Validate tells whether the kernel accepts the limits
+func (l Limits) Validate() error {
+	if l.PidsMax < 0 {
+		return fmt.Errorf("the process limit can not be negative")
+	}
+
+	if l.MemoryMax < 0 {
+		return fmt.Errorf("the memory limit can not be negative")
+	}
+
+	if l.CPUMax != 0 && !(l.CPUMax >= minCPU) {
+		return fmt.Errorf("invalid CPU limit %g, expected 0 for no limit or at least %g CPUs", l.CPUMax, minCPU)
+	}
+
+	if l.CPUMax > maxCPU {
+		return fmt.Errorf("the CPU limit %g is too large", l.CPUMax)
+	}
+
+	return nil
+}
+
+// String describes the limits for logs and reports
+func (l Limits) String() string {
+	var parts []string
+	if l.PidsMax > 0 {
+		parts = append(parts, fmt.Sprintf("%d processes", l.PidsMax))
+	}
+	if l.MemoryMax > 0 {
+		parts = append(parts, fmt.Sprintf("%d MiB of memory", l.MemoryMax>>20))
+	}
+	if l.CPUMax > 0 {
+		parts = append(parts, fmt.Sprintf("%g CPUs", l.CPUMax))
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// ParseSize parses a memory size in bytes, or with a K, M or G suffix (powers of 1024)
+func ParseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	number, shift := value, 0
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift > 0 {
+		number = value[:len(value)-1]
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q, expected bytes or a number with a K, M or G suffix", value)
+	}
+
+	return size << shift, nil
+}
+
+// cgroup is the cgroup v2 of a session
+type cgroup struct {
+	path string
+	dir  *os.File // given to clone3 so the init process starts in the cgroup
+}
+
+// cgroupMount is a mount of the cgroup v2 hierarchy: path is where it is
+// mounted, root the cgroup of the hierarchy it shows there
+type cgroupMount struct {
+	path string
+	root string
+}
+
+// findCgroupMount finds the cgroup v2 hierarchy in /proc/self/mountinfo. It is
+// mounted at /sys/fs/cgroup on current distributions, at /sys/fs/cgroup/unified
+// on hosts that still use cgroup v1 for the controllers.
+func findCgroupMount(mountinfo string) (cgroupMount, error) {
+	for _, line := range strings.Split(mountinfo, "\n") {
+		// The optional fields end with a "-", the filesystem type follows
+		fields, filesystem, found := strings.Cut(line, " - ")
+		if !found || !strings.HasPrefix(filesystem, "cgroup2 ") {
+			continue
+		}
+
+		parts := strings.Fields(fields)
+		if len(parts) < 5 {
+			continue
+		}
+
+		return cgroupMount{path: unescapeMountinfo(parts[4]), root: unescapeMountinfo(parts[3])}, nil
+	}
+
+	return cgroupMount{}, errors.New("resource limits need the cgroup v2 hierarchy, which is not mounted")
+}
+
+// unescapeMountinfo decodes the octal escapes of spaces, tabs, newlines and
+// backslashes in the paths of /proc/self/mountinfo
+func unescapeMountinfo(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+
+	return b.String()
+}
+
+// findCgroup reads the cgroup v2 of the process in /proc/self/cgroup, on the
+// "0::" line
+func findCgroup(procCgroup string) (string, error) {
+	for _, line := range strings.Split(procCgroup, "\n") {
+		if path, found := strings.CutPrefix(line, "0::"); found && strings.HasPrefix(path, "/") {
+			return path, nil
+		}
+	}
+
+	return "", errors.New("qo is not in a cgroup v2")
+}
+
+// cgroupDirs returns the folder of the mount, where the hierarchy starts for
+// qo, and the folder of the cgroup of qo in it
+func cgroupDirs() (string, string, error) {
+	mountinfo, err := os.ReadFile(mountinfoPath)
+	if err != nil {
+		return "", "", err
+	}
+	mount, err := findCgroupMount(string(mountinfo))
+	if err != nil {
+		return "", "", err
+	}
+
+	procCgroup, err := os.ReadFile(procCgroupPath)
+	if err != nil {
+		return "", "", err
+	}
+	current, err := findCgroup(string(procCgroup))
+	if err != nil {
+		return "", "", err
+	}
+
+	// In a container, the mount may only show the cgroup of the container
+	rel, err := filepath.Rel(mount.root, current)
+	if err != nil || !filepath.IsLocal(rel) && rel != "." {
+		return "", "", fmt.Errorf("the cgroup of qo, %s, is not under the cgroup v2 hierarchy mounted at %s", current, mount.path)
+	}
+
+	return mount.path, filepath.Join(mount.path, rel), nil
+}
+
+// cgroupPlace is where the cgroups of the sandbox are created: in parent, a
+// folder of the hierarchy mounted at top
+type cgroupPlace struct {
+	top    string
+	parent string
+}
+
+// findCgroupPlace is run once: it may move qo into a cgroup of its own
+var findCgroupPlace = sync.OnceValues(func() (cgroupPlace, error) {
+	top, current, err := cgroupDirs()
+	if err != nil {
+		return cgroupPlace{}, err
+	}
+
+	parent, err := sandboxCgroupParent(top, current, os.Getpid())
+	return cgroupPlace{top: top, parent: parent}, err
+})
+
+// sandboxCgroupParent picks the folder the cgroups of the sandbox are created
+// in, as close to the cgroup of qo, current, as the kernel allows: a cgroup
+// can not hold processes and give controllers to its children at the same
+// time, only the root of the whole hierarchy can.
+//   - When qo is alone in its cgroup, in a scope delegated to it for example,
+//     qo moves into a child cgroup of its own, qo-main-<pid>, and the cgroups
+//     of the sandbox go next to it.
+//   - Otherwise, when qo shares its cgroup with the shell it was started from,
+//     they go in the closest parent without processes, the slice of the user
+//     on systemd hosts, or at the top of the hierarchy.
+func sandboxCgroupParent(top, current string, pid int) (string, error) {
+	procs, err := os.ReadFile(filepath.Join(current, "cgroup.procs"))
+	if err != nil {
+		return "", err
+	}
+
+	if slices.Equal(strings.Fields(string(procs)), []string{strconv.Itoa(pid)}) {
+		own := filepath.Join(current, fmt.Sprintf("qo-main-%d", pid))
+		if err := os.Mkdir(own, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		if err := os.WriteFile(filepath.Join(own, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return "", fmt.Errorf("moving qo into %s: %w", own, err)
+		}
+
+		return current, nil
+	}
+
+	for dir := current; dir != top; {
+		dir = filepath.Dir(dir)
+
+		procs, err := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+		if err != nil {
+			return "", err
+		}
+		if len(strings.Fields(string(procs))) == 0 {
+			return dir, nil
+		}
+	}
+
+	return top, nil
+}
+
+// createCgroup creates a cgroup with limits next to the cgroup of qo, see
+// sandboxCgroupParent
+func createCgroup(name string, limits Limits) (*cgroup, error) {
+	place, err := findCgroupPlace()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := enableControllers(place.top, place.parent, limits); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(place.parent, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, err
+	}
+
+	group := &cgroup{path: path}
+
+	settings := map[string]string{}
+	if limits.PidsMax > 0 {
+		settings["pids.max"] = strconv.FormatInt(limits.PidsMax, 10)
+	}
+	if limits.MemoryMax > 0 {
+		settings["memory.max"] = strconv.FormatInt(limits.MemoryMax, 10)
+
+		// Swapping out would get around memory.max
+		if _, err := os.Stat(filepath.Join(path, "memory.swap.max")); err == nil {
+			settings["memory.swap.max"] = "0"
+		}
+	}
+	if limits.CPUMax > 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d %d", int64(limits.CPUMax*cpuPeriod), cpuPeriod)
+	}
+
+	for file, value := range settings {
+		if err := group.write(file, value); err != nil {
+			group.remove()
+			return nil, err
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		group.remove()
+		return nil, err
+	}
+	group.dir = dir
+
+	return group, nil
+}
+
+// enableControllers makes the controllers the limits need, and the memory
+// controller whose events are recorded, available to the children of parent.
+// A cgroup only gets the controllers its parent enabled, so they are enabled
+// in every cgroup from top down to parent.
+func enableControllers(top, parent string, limits Limits) error {
+	needed := map[string]bool{
+		"pids":   limits.PidsMax > 0,
+		"memory": limits.MemoryMax > 0,
+		"cpu":    limits.CPUMax > 0,
+	}
+
+	dirs := []string{parent}
+	for dir := parent; dir != top; {
+		dir = filepath.Dir(dir)
+		dirs = append(dirs, dir)
+	}
+	slices.Reverse(dirs)
+
+	for _, dir := range dirs {
+		data, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+		if err != nil {
+			return err
+		}
+		available := strings.Fields(string(data))
+
+		for _, controller := range []string{"pids", "memory", "cpu"} {
+			if !slices.Contains(available, controller) {
+				if needed[controller] {
+					return fmt.Errorf("the %s cgroup controller is not available in %s", controller, dir)
+				}
+				continue
+			}
+
+			if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0644); err != nil && needed[controller] {
+				return fmt.Errorf("enabling the %s cgroup controller in %s: %w", controller, dir, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *cgroup) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(c.path, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("setting %s: %w", file, err)
+	}
+
+	return nil
+}
+
+// events reads how often the processes of the cgroup ran into its limits
+func (c *cgroup) events(report *LimitReport) error {
+	memory, err := readEvents(filepath.Join(c.path, "memory.events"))
+	if err != nil {
+		return err
+	}
+	report.OOMKills = memory["oom_kill"]
+	report.MemoryMaxHits = memory["max"]
+
+	pids, err := readEvents(filepath.Join(c.path, "pids.events"))
+	if err != nil {
+		return err
+	}
+	report.PidsMaxRefused = pids["max"]
+
+	return nil
+}
+
+// readEvents parses a flat keyed cgroup file, a missing file has no events
+func readEvents(path string) (map[string]int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := make(map[string]int64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		events[key], _ = strconv.ParseInt(value, 10, 64)
+	}
+
+	return events, scanner.Err()
+}
+
+// remove kills what is left in the cgroup and removes it
+func (c *cgroup) remove() error {
+	if c.dir != nil {
+		c.dir.Close()
+	}
+
+	_ = c.write("cgroup.kill", "1")
+
+	// The killed processes take a moment to leave the cgroup
+	var err error
+	for range 50 {
+		if err = os.Remove(c.path); err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return err
+}
+
+// unlimitedWarning is shown once, not for every check script
+var unlimitedWarning sync.Once
+
+// limitSandbox creates the cgroup name and makes attr start the process in
+// it. Limits that can not be enforced, without root or cgroup v2, are an
+// error, unless bestEffort is set: then it returns a nil cgroup after a warning.
+func limitSandbox(name string, limits Limits, bestEffort bool, attr *syscall.SysProcAttr) (*cgroup, error) {
+	if limits.IsZero() {
+		return nil, nil
+	}
+
+	if err := limits.Validate(); err != nil {
+		return nil, err
+	}
+
+	var group *cgroup
+	err := errors.New("resource limits need qo to run as root")
+	if !Rootless() {
+		group, err = createCgroup(fmt.Sprintf("%s-%d", name, os.Getpid()), limits)
+	}
+
+	if err != nil {
+		if !bestEffort {
+			return nil, fmt.Errorf("the sandbox can not be limited to %s: %w", limits, err)
+		}
+
+		unlimitedWarning.Do(func() {
+			logger.Warn(fmt.Sprintf("The sandbox is not limited to %s: %s.", limits, err))
+		})
+		return nil, nil
+	}
+
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(group.dir.Fd())
+
+	return group, nil
+}
@@ -0,0 +1,150 @@
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindCgroupMount(t *testing.T) {
+	tests := []struct {
+		name      string
+		mountinfo string
+		want      cgroupMount
+		wantErr   bool
+	}{
+		{
+			"unified",
+			"22 1 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw\n" +
+				"30 24 0:26 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime shared:4 - cgroup2 cgroup2 rw,nsdelegate,memory_recursiveprot\n",
+			cgroupMount{path: "/sys/fs/cgroup", root: "/"},
+			false,
+		},
+		{
+			"hybrid",
+			"32 24 0:27 / /sys/fs/cgroup ro,nosuid,nodev,noexec shared:9 - tmpfs tmpfs ro,mode=755\n" +
+				"33 32 0:28 / /sys/fs/cgroup/systemd rw,nosuid,nodev,noexec,relatime shared:10 - cgroup cgroup rw,xattr,name=systemd\n" +
+				"34 32 0:29 / /sys/fs/cgroup/pids rw,nosuid,nodev,noexec,relatime shared:14 - cgroup cgroup rw,pids\n" +
+				"42 32 0:38 / /sys/fs/cgroup/unified rw,relatime - cgroup2 cgroup2 rw\n",
+			cgroupMount{path: "/sys/fs/cgroup/unified", root: "/"},
+			false,
+		},
+		{
+			"container",
+			"612 600 0:26 /docker/0123abcd /sys/fs/cgroup ro,nosuid,nodev,noexec,relatime - cgroup2 cgroup rw\n",
+			cgroupMount{path: "/sys/fs/cgroup", root: "/docker/0123abcd"},
+			false,
+		},
+		{
+			"escaped",
+			"90 24 0:26 /lab\\040room /mnt/cgroup\\040v2 rw,relatime shared:4 - cgroup2 none rw\n",
+			cgroupMount{path: "/mnt/cgroup v2", root: "/lab room"},
+			false,
+		},
+		{
+			"cgroup v1 only",
+			"34 32 0:29 / /sys/fs/cgroup/pids rw,nosuid,nodev,noexec,relatime shared:14 - cgroup cgroup rw,pids\n",
+			cgroupMount{},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		got, err := findCgroupMount(test.mountinfo)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: found %+v, want an error", test.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("%s: found %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFindCgroup(t *testing.T) {
+	tests := []struct {
+		procCgroup string
+		want       string
+		wantErr    bool
+	}{
+		{"0::/user.slice/user-1000.slice/session-2.scope\n", "/user.slice/user-1000.slice/session-2.scope", false},
+		{"12:pids:/user.slice/user-1000.slice\n1:name=systemd:/user.slice/user-1000.slice/session-2.scope\n0::/user.slice/user-1000.slice/session-2.scope\n", "/user.slice/user-1000.slice/session-2.scope", false},
+		{"0::/\n", "/", false},
+		{"12:pids:/\n1:name=systemd:/\n", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := findCgroup(test.procCgroup)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("findCgroup(%q) = %q, want an error", test.procCgroup, got)
+			}
+			continue
+		}
+
+		if err != nil || got != test.want {
+			t.Errorf("findCgroup(%q) = %q, %v, want %q", test.procCgroup, got, err, test.want)
+		}
+	}
+}
+
+// TestSandboxCgroupParent picks the parent in a copy of the hierarchy of a
+// systemd host, where only cgroup.procs is read
+func TestSandboxCgroupParent(t *testing.T) {
+	const pid = 4242
+
+	top := t.TempDir()
+	procs := map[string]string{
+		"":                                  "1\n",
+		"user.slice":                        "",
+		"user.slice/user-1000.slice":        "",
+		"user.slice/user-1000.slice/shared": "1200\n4242\n",
+		"user.slice/user-1000.slice/alone":  "4242\n",
+		"system.slice":                      "",
+		"system.slice/busy":                 "900\n",
+		"system.slice/busy/shared":          "901\n4242\n",
+	}
+	for dir, content := range procs {
+		if err := os.MkdirAll(filepath.Join(top, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(top, dir, "cgroup.procs"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		current string
+		want    string
+	}{
+		{"user.slice/user-1000.slice/shared", "user.slice/user-1000.slice"},
+		{"user.slice/user-1000.slice/alone", "user.slice/user-1000.slice/alone"},
+		{"system.slice/busy/shared", "system.slice"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		got, err := sandboxCgroupParent(top, filepath.Join(top, test.current), pid)
+		if err != nil {
+			t.Errorf("%q: %v", test.current, err)
+			continue
+		}
+
+		if want := filepath.Join(top, test.want); got != want {
+			t.Errorf("%q: the parent is %s, want %s", test.current, got, want)
+		}
+	}
+
+	// qo moves out of the cgroup it is alone in
+	moved, err := os.ReadFile(filepath.Join(top, "user.slice/user-1000.slice/alone/qo-main-4242/cgroup.procs"))
+	if err != nil || string(moved) != "4242" {
+		t.Errorf("qo is not moved into its own cgroup: %q, %v", moved, err)
+	}
+}
@@ -0,0 +1,235 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// maxCheckOutput is how much of the stdout and of the stderr of a check
+// script is kept, from the end: a script printing in a loop would otherwise
+// fill the memory of qo before its timeout
+const maxCheckOutput = 64 << 10
+
+// CheckResult is the outcome of running a check script inside the sandbox
+type CheckResult struct {
+	ExitCode int
+	TimedOut bool
+	Duration time.Duration
+	Stdout   []byte // the last maxCheckOutput bytes, after a line telling how many were cut
+	Stderr   []byte
+}
+
+// Passed tells whether the script finished in time with a zero exit status
+func (r CheckResult) Passed() bool {
+	return r.ExitCode == 0 && !r.TimedOut
+}
+
+// CheckConfig controls how a check script is run. Checks see the sandbox the
+// way the student did, in the same namespaces and on the same network.
+type CheckConfig struct {
+	// Timeout is how long the script may run.
+	Timeout time.Duration
+
+	// Network is what the sandbox is connected to, the loopback network when empty.
+	Network Network
+
+	// Namespaces the check is isolated in, every namespace when empty.
+	Namespaces []Namespace
+
+	// Limits are the resource limits of the cgroup of the check, see Config.
+	Limits Limits
+
+	// BestEffortLimits runs the check unlimited when Limits can not be enforced, see Config.
+	BestEffortLimits bool
+}
+
+// RunCheck injects script, a check script kept outside the rootfs, into the
+// sandbox and runs it there in fresh namespaces and its own cgroup as the
+// default user. The script and everything it started are killed after
+// cfg.Timeout.
+func RunCheck(script string, cfg CheckConfig) (CheckResult, error) {
+	if err := checkNetwork(cfg.Network, cfg.Namespaces); err != nil {
+		return CheckResult{}, err
+	}
+
+	injected, injectDir, err := injectScript(script)
+	if err != nil {
+		return CheckResult{}, err
+	}
+	defer os.RemoveAll(injectDir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	attr, err := sandboxAttr(cfg.Namespaces)
+	if err != nil {
+		return CheckResult{}, err
+	}
+
+	group, err := limitSandbox("qo-check", cfg.Limits, cfg.BestEffortLimits, attr)
+	if err != nil {
+		return CheckResult{}, err
+	}
+	if group != nil {
+		defer group.remove()
+	}
+
+	stdout, stderr := tailWriter{max: maxCheckOutput}, tailWriter{max: maxCheckOutput}
+
+	cmd := exec.CommandContext(ctx, "/proc/self/exe")
+	cmd.Args = []string{"check", injected}
+	cmd.Env = sandboxEnv()
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second
+	cmd.SysProcAttr = attr
+
+	// The check process waits on networkFd until the virtual ethernet pair is created
+	var networkR, networkW *os.File
+	if cfg.Network == NetworkVeth {
+		if networkR, networkW, err = os.Pipe(); err != nil {
+			return CheckResult{}, err
+		}
+
+		cmd.Env = append(cmd.Env, networkEnv+"="+string(NetworkVeth))
+		cmd.ExtraFiles = []*os.File{nil, networkR} // networkFd in the check process
+	}
+
+	start := time.Now()
+	err = startSandboxProcess(cmd)
+	if networkR != nil {
+		networkR.Close()
+	}
+	if err != nil {
+		if networkW != nil {
+			networkW.Close()
+		}
+		return CheckResult{}, err
+	}
+
+	if networkW != nil {
+		if err := startVeth(cmd.Process.Pid, networkW); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return CheckResult{}, err
+		}
+	}
+
+	err = cmd.Wait()
+
+	result := CheckResult{
+		Duration: time.Since(start),
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		result.ExitCode = -1
+		result.TimedOut = true
+		return result, nil
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+		return result, nil
+	}
+
+	return result, err
+}
+
+// tailWriter keeps the last max bytes written to it
+type tailWriter struct {
+	max  int
+	data []byte
+	cut  int64 // bytes dropped from data
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	if len(p) >= w.max {
+		w.cut += int64(len(w.data) + len(p) - w.max)
+		w.data = append(w.data[:0], p[len(p)-w.max:]...)
+		return len(p), nil
+	}
+
+	// Up to twice max is kept, so that the data is not moved on every write
+	w.data = append(w.data, p...)
+	if len(w.data) > 2*w.max {
+		over := len(w.data) - w.max
+		w.cut += int64(over)
+		w.data = append(w.data[:0], w.data[over:]...)
+	}
+
+	return len(p), nil
+}
+
+// Bytes returns the last max bytes written, after a line telling how many
+// were cut before them
+func (w *tailWriter) Bytes() []byte {
+	data, cut := w.data, w.cut
+	if len(data) > w.max {
+		cut += int64(len(data) - w.max)
+		data = data[len(data)-w.max:]
+	}
+
+	if cut == 0 {
+		return data
+	}
+
+	return append([]byte(fmt.Sprintf("[%d bytes cut]\n", cut)), data...)
+}
+
+// injectScript copies script into a new randomly named directory at the root
+// of the rootfs. It returns the path of the copy as seen from inside the
+// sandbox, and the directory to remove once the check is done.
+func injectScript(script string) (string, string, error) {
+	data, err := os.ReadFile(script)
+	if err != nil {
+		return "", "", err
+	}
+
+	dir, err := os.MkdirTemp(Rootfs, ".qo-check-")
+	if err != nil {
+		return "", "", err
+	}
+
+	// The check runs as the default user, it has to be able to reach the script
+	if err := os.Chmod(dir, 0755); err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "check.sh"), data, 0755); err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+
+	return filepath.Join("/", filepath.Base(dir), "check.sh"), dir, nil
+}
+
+// CheckSandBox runs inside the namespaces created by RunCheck: it sets up the
+// network, enters the rootfs as the default user and replaces itself with the
+// check script.
+func CheckSandBox(script string) error {
+	if err := setupLoopback(); err != nil {
+		return err
+	}
+
+	if err := joinVeth(); err != nil {
+		return err
+	}
+
+	if err := enterRootfs(); err != nil {
+		return err
+	}
+
+	if err := dropToUser(defaultUser); err != nil {
+		return err
+	}
+
+	return syscall.Exec(script, []string{script}, os.Environ())
+}
@@ -0,0 +1,47 @@
+package sandbox
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTailWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"nothing", nil, ""},
+		{"under the limit", []string{"abc", "de"}, "abcde"},
+		{"at the limit", []string{"abcd", "efgh"}, "abcdefgh"},
+		{"small writes", []string{"abc", "def", "ghi", "jkl", "mno", "pqr"}, "[10 bytes cut]\nklmnopqr"},
+		{"a large write", []string{"ab", "cdefghijklmnop"}, "[8 bytes cut]\nijklmnop"},
+		{"a write of the limit", []string{"abc", "defghijk"}, "[3 bytes cut]\ndefghijk"},
+	}
+
+	for _, test := range tests {
+		w := tailWriter{max: 8}
+		for _, write := range test.writes {
+			if n, err := w.Write([]byte(write)); n != len(write) || err != nil {
+				t.Fatalf("%s: Write(%q) = %d, %v", test.name, write, n, err)
+			}
+		}
+
+		if got := string(w.Bytes()); got != test.want {
+			t.Errorf("%s: kept %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// The data is not kept growing between the writes
+	w := tailWriter{max: 8}
+	for range 1000 {
+		w.Write([]byte("012"))
+	}
+	if len(w.data) > 2*w.max {
+		t.Errorf("%d bytes are kept, want at most %d", len(w.data), 2*w.max)
+	}
+	if got := w.Bytes(); !bytes.HasPrefix(got, []byte("[2992 bytes cut]\n")) || !strings.HasSuffix(string(got), "12012012") {
+		t.Errorf("kept %q after 3000 bytes", got)
+	}
+}
@@ -0,0 +1,115 @@
+package sandbox
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Directories searched for binaries in the sandbox, like the PATH of the student's shell
+var searchPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// maxSymlinks bounds symbolic link resolution, like the kernel does
+const maxSymlinks = 40
+
+// rootfsIndex lists the entries of the embedded rootfs by their absolute path inside it
+var rootfsIndex = sync.OnceValues(func() (map[string]*tar.Header, error) {
+	gzReader, err := gzip.NewReader(bytes.NewReader(embeddedRootfs))
+	if err != nil {
+		return nil, err
+	}
+	defer gzReader.Close()
+
+	index := make(map[string]*tar.Header)
+	tarReader := tar.NewReader(gzReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Entries are named rootfs/..., the first element is the rootfs itself
+		_, name, _ := strings.Cut(strings.TrimPrefix(header.Name, "./"), "/")
+		index[path.Clean("/"+name)] = header
+	}
+
+	return index, nil
+})
+
+// LookPath searches the embedded rootfs for an executable named file, the way
+// exec.LookPath does on the host: names with a slash are used as they are,
+// others are searched in the directories of the sandbox PATH. It returns the
+// path of the binary inside the rootfs.
+func LookPath(file string) (string, error) {
+	index, err := rootfsIndex()
+	if err != nil {
+		return "", err
+	}
+
+	candidates := []string{file}
+	if !strings.Contains(file, "/") {
+		candidates = candidates[:0]
+		for _, dir := range searchPath {
+			candidates = append(candidates, path.Join(dir, file))
+		}
+	}
+
+	for _, candidate := range candidates {
+		header, ok := resolve(index, candidate)
+		if ok && header.Typeflag == tar.TypeReg && header.Mode&0111 != 0 {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s: not found in the sandbox rootfs", file)
+}
+
+// resolve follows the symbolic links of name inside the rootfs
+func resolve(index map[string]*tar.Header, name string) (*tar.Header, bool) {
+	resolved := "/"
+	remaining := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+
+	for links := 0; len(remaining) > 0; {
+		element := remaining[0]
+		remaining = remaining[1:]
+
+		current := path.Join(resolved, element)
+		header, ok := index[current]
+		if !ok {
+			return nil, false
+		}
+
+		if header.Typeflag != tar.TypeSymlink {
+			resolved = current
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return nil, false
+		}
+
+		// Restart from the target, absolute targets are relative to the rootfs
+		target := header.Linkname
+		if !path.IsAbs(target) {
+			target = path.Join(resolved, target)
+		}
+
+		resolved = "/"
+		remaining = append(strings.Split(strings.Trim(path.Clean(target), "/"), "/"), remaining...)
+	}
+
+	header, ok := index[resolved]
+	if !ok && resolved == "/" {
+		return &tar.Header{Typeflag: tar.TypeDir}, true
+	}
+
+	return header, ok
+}
@@ -0,0 +1,86 @@
+package sandbox
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// Namespace is a Linux namespace the sandbox processes are isolated in
+type Namespace string
+
+const (
+	NamespaceUTS    Namespace = "uts"
+	NamespacePID    Namespace = "pid"
+	NamespaceMount  Namespace = "mount"
+	NamespaceNet    Namespace = "net"
+	NamespaceIPC    Namespace = "ipc"
+	NamespaceCgroup Namespace = "cgroup"
+)
+
+var namespaceFlags = map[Namespace]uintptr{
+	NamespaceUTS:    syscall.CLONE_NEWUTS,
+	NamespacePID:    syscall.CLONE_NEWPID,
+	NamespaceMount:  syscall.CLONE_NEWNS,
+	NamespaceNet:    syscall.CLONE_NEWNET,
+	NamespaceIPC:    syscall.CLONE_NEWIPC,
+	NamespaceCgroup: syscall.CLONE_NEWCGROUP,
+}
+
+// DefaultNamespaces isolates the sandbox in every namespace
+var DefaultNamespaces = []Namespace{NamespaceUTS, NamespacePID, NamespaceMount, NamespaceNet, NamespaceIPC, NamespaceCgroup}
+
+// requiredNamespaces can not be left out: the session ends by killing the
+// init process of the PID namespace, and /proc is mounted in the mount namespace
+var requiredNamespaces = []Namespace{NamespacePID, NamespaceMount}
+
+// ParseNamespaces parses a list of namespace names. An empty list is every namespace.
+func ParseNamespaces(names []string) ([]Namespace, error) {
+	if len(names) == 0 {
+		return DefaultNamespaces, nil
+	}
+
+	var namespaces []Namespace
+	for _, name := range names {
+		namespace := Namespace(strings.TrimSpace(name))
+		if _, ok := namespaceFlags[namespace]; !ok {
+			return nil, fmt.Errorf("unknown namespace %q, expected some of %s", name, joinNamespaces(DefaultNamespaces))
+		}
+
+		if !slices.Contains(namespaces, namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+
+	for _, required := range requiredNamespaces {
+		if !slices.Contains(namespaces, required) {
+			return nil, fmt.Errorf("the %s namespace is required by the sandbox", required)
+		}
+	}
+
+	return namespaces, nil
+}
+
+// cloneFlags returns the clone flags creating namespaces, every namespace when it is empty
+func cloneFlags(namespaces []Namespace) uintptr {
+	if len(namespaces) == 0 {
+		namespaces = DefaultNamespaces
+	}
+
+	var flags uintptr
+	for _, namespace := range namespaces {
+		flags |= namespaceFlags[namespace]
+	}
+
+	return flags
+}
+
+func joinNamespaces(namespaces []Namespace) string {
+	names := make([]string, len(namespaces))
+	for i, namespace := range namespaces {
+		names[i] = string(namespace)
+	}
+
+	return strings.Join(names, ", ")
+}
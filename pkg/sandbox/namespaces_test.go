@@ -0,0 +1,198 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// RunCheck and RemoveRootfs start the sandbox processes from /proc/self/exe,
+// the test binary
+func TestMain(m *testing.M) {
+	if err := WaitIDMap(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) == 1 && os.Args[0] == "clean" {
+		if err := CleanSandBox(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(os.Args) == 2 && os.Args[0] == "check" {
+		if err := CheckSandBox(os.Args[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestParseNamespaces(t *testing.T) {
+	tests := []struct {
+		names   []string
+		want    []Namespace
+		wantErr bool
+	}{
+		{nil, DefaultNamespaces, false},
+		{[]string{"pid", "mount", "net"}, []Namespace{NamespacePID, NamespaceMount, NamespaceNet}, false},
+		{[]string{"pid", " mount", "pid"}, []Namespace{NamespacePID, NamespaceMount}, false},
+		{[]string{"pid", "user"}, nil, true},
+		{[]string{"pid", "net"}, nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseNamespaces(test.names)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseNamespaces(%q) = %v, want an error", test.names, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseNamespaces(%q) failed: %v", test.names, err)
+			continue
+		}
+
+		if joinNamespaces(got) != joinNamespaces(test.want) {
+			t.Errorf("ParseNamespaces(%q) = %v, want %v", test.names, got, test.want)
+		}
+	}
+}
+
+// useTempRootfs extracts the rootfs for the test and removes it afterwards
+func useTempRootfs(t *testing.T) {
+	t.Helper()
+
+	if err := ExtractRootfs(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if err := RemoveRootfs(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// TestExtractRootfs checks that each extraction gets a folder of its own and
+// that RemoveRootfs removes it with the check scripts
+func TestExtractRootfs(t *testing.T) {
+	useTempRootfs(t)
+	first := Rootfs
+
+	useTempRootfs(t)
+	if Rootfs == first {
+		t.Fatalf("the rootfs %s was extracted twice to the same folder", Rootfs)
+	}
+	if pathExists(first) {
+		t.Errorf("the previous rootfs %s was not removed", first)
+	}
+	if !pathExists(filepath.Join(Rootfs, "etc", "passwd")) || !pathExists(ChecksDir) {
+		t.Fatalf("%s or %s is missing", filepath.Join(Rootfs, "etc", "passwd"), ChecksDir)
+	}
+
+	dir := filepath.Dir(Rootfs)
+	if err := RemoveRootfs(); err != nil {
+		t.Fatal(err)
+	}
+	if pathExists(dir) {
+		t.Errorf("%s was not removed", dir)
+	}
+}
+
+// TestIPCNamespace creates a System V shared memory segment on the host and
+// looks for it from a check script, which runs in the namespaces of the
+// session: an archive keeping the IPC namespace of the host sees it.
+func TestIPCNamespace(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the sandbox is tested as root")
+	}
+
+	useTempRootfs(t)
+
+	id, err := unix.SysvShmGet(unix.IPC_PRIVATE, 4096, unix.IPC_CREAT|0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.SysvShmCtl(id, unix.IPC_RMID, nil) })
+
+	// Prints the ids of the segments the script sees, with bash builtins only
+	script := filepath.Join(t.TempDir(), "check.sh")
+	listSegments := "#!/bin/bash\n{ read -r _; while read -r _ shmid _; do echo \"$shmid\"; done; } < /proc/sysvipc/shm\n"
+	if err := os.WriteFile(script, []byte(listSegments), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		namespaces []Namespace
+		visible    bool
+	}{
+		{"isolated", nil, false},
+		{"every namespace", DefaultNamespaces, false},
+		{"without ipc", []Namespace{NamespaceUTS, NamespacePID, NamespaceMount, NamespaceNet, NamespaceCgroup}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := RunCheck(script, CheckConfig{Timeout: 10 * time.Second, Namespaces: test.namespaces})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Passed() {
+				t.Fatalf("the check failed with status %d: %s", result.ExitCode, result.Stderr)
+			}
+
+			visible := false
+			for _, segment := range strings.Fields(string(result.Stdout)) {
+				visible = visible || segment == strconv.Itoa(id)
+			}
+
+			if visible != test.visible {
+				t.Errorf("the segment %d of the host is visible: %t, want %t", id, visible, test.visible)
+			}
+		})
+	}
+}
+
+// TestGroups checks that the student keeps none of the groups of qo
+func TestGroups(t *testing.T) {
+	if Rootless() && userIDs() == nil {
+		t.Skip("setgroups is denied in rootless sandboxes without subordinate ids")
+	}
+
+	useTempRootfs(t)
+
+	_, gid, _, err := lookupUser(filepath.Join(Rootfs, "etc", "passwd"), defaultUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := filepath.Join(t.TempDir(), "check.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/bash\nid -G\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := RunCheck(script, CheckConfig{Timeout: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Passed() {
+		t.Fatalf("id -G failed with status %d: %s", result.ExitCode, result.Stderr)
+	}
+
+	if groups := strings.TrimSpace(string(result.Stdout)); groups != strconv.Itoa(gid) {
+		t.Errorf("the student is in the groups %q, want only %d", groups, gid)
+	}
+}
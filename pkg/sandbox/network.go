@@ -0,0 +1,253 @@
+package sandbox
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Network is what the sandbox network namespace is connected to
+type Network string
+
+const (
+	// NetworkLoopback isolates the sandbox, only its loopback interface is up
+	NetworkLoopback Network = "loopback"
+
+	// NetworkVeth links the sandbox to the host with a virtual ethernet pair.
+	// Students reach the services listening on the host, not the internet.
+	NetworkVeth Network = "veth"
+)
+
+// vethSandboxName is the interface of the sandbox end of the virtual ethernet
+// pair, the sandbox has no default route
+const vethSandboxName = "eth0"
+
+// vethRange holds the /30 subnets of the virtual ethernet pairs, one for each
+// sandbox so that sessions and check scripts running at the same time do not
+// route to each other
+var vethRange = netip.MustParsePrefix("10.200.0.0/16")
+
+const (
+	// networkEnv tells the init process which network to set up
+	networkEnv = "QO_NETWORK"
+
+	// networkFd is the file descriptor, inherited from qo, the addresses of
+	// the virtual ethernet pair are read from once it is created
+	networkFd = 4
+
+	// hostAddressEnv gives the student's shell and the check scripts the
+	// address of the host on the veth network
+	hostAddressEnv = "QO_HOST_ADDRESS"
+)
+
+// ParseNetwork parses a network name, an empty name is the loopback network
+func ParseNetwork(value string) (Network, error) {
+	switch Network(value) {
+	case "", NetworkLoopback:
+		return NetworkLoopback, nil
+	case NetworkVeth:
+		return NetworkVeth, nil
+	default:
+		return "", fmt.Errorf("unknown network %q, expected %q or %q", value, NetworkLoopback, NetworkVeth)
+	}
+}
+
+// checkNetwork tells whether network can be set up for a sandbox isolated in namespaces
+func checkNetwork(network Network, namespaces []Namespace) error {
+	if network != NetworkVeth {
+		return nil
+	}
+
+	if len(namespaces) > 0 && !slices.Contains(namespaces, NamespaceNet) {
+		return fmt.Errorf("the %s network needs the %s namespace", NetworkVeth, NamespaceNet)
+	}
+
+	if Rootless() {
+		return fmt.Errorf("the %s network needs qo to run as root", NetworkVeth)
+	}
+
+	if _, err := exec.LookPath("ip"); err != nil {
+		return fmt.Errorf("the %s network needs the ip command of iproute2: %w", NetworkVeth, err)
+	}
+
+	return nil
+}
+
+// setupLoopback brings the loopback interface of the sandbox network namespace up
+func setupLoopback() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+
+	// Without a network namespace this is the loopback interface of the host
+	if ifr.Uint16()&unix.IFF_UP != 0 {
+		return nil
+	}
+
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+// freeVethSubnet picks a /30 of vethRange that overlaps none of the used
+// subnets, trying first the one derived from the pid of the sandbox
+func freeVethSubnet(pid int, used []netip.Prefix) (netip.Prefix, error) {
+	count := 1 << (32 - 2 - vethRange.Bits())
+	base := vethRange.Addr().As4()
+	first := binary.BigEndian.Uint32(base[:])
+
+	for i := range count {
+		var addr [4]byte
+		binary.BigEndian.PutUint32(addr[:], first+uint32((pid+i)%count)<<2)
+		subnet := netip.PrefixFrom(netip.AddrFrom4(addr), 30)
+
+		if !slices.ContainsFunc(used, subnet.Overlaps) {
+			return subnet, nil
+		}
+	}
+
+	return netip.Prefix{}, fmt.Errorf("no free subnet is left in %s for the virtual network of the sandbox", vethRange)
+}
+
+// hostSubnets lists the subnets of the addresses of the host interfaces,
+// those of the other sandboxes included
+func hostSubnets() ([]netip.Prefix, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var subnets []netip.Prefix
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok {
+				bits, _ := ipNet.Mask.Size()
+				subnets = append(subnets, netip.PrefixFrom(ip.Unmap(), bits).Masked())
+			}
+		}
+	}
+
+	return subnets, nil
+}
+
+// createVeth creates the virtual ethernet pair of the sandbox whose init
+// process is pid, in a free subnet, and moves one end into its network
+// namespace. It runs on the host, as root, and returns the addresses of the
+// host and sandbox ends.
+func createVeth(pid int) (netip.Prefix, netip.Prefix, error) {
+	used, err := hostSubnets()
+	if err != nil {
+		return netip.Prefix{}, netip.Prefix{}, err
+	}
+
+	subnet, err := freeVethSubnet(pid, used)
+	if err != nil {
+		return netip.Prefix{}, netip.Prefix{}, err
+	}
+	hostAddress := netip.PrefixFrom(subnet.Addr().Next(), subnet.Bits())
+	sandboxAddress := netip.PrefixFrom(hostAddress.Addr().Next(), subnet.Bits())
+
+	host := fmt.Sprintf("qo%d", pid)
+	if err := ip("link", "add", host, "type", "veth", "peer", "name", vethSandboxName, "netns", strconv.Itoa(pid)); err != nil {
+		return netip.Prefix{}, netip.Prefix{}, err
+	}
+
+	for _, args := range [][]string{
+		{"addr", "add", hostAddress.String(), "dev", host},
+		{"link", "set", host, "up"},
+	} {
+		if err := ip(args...); err != nil {
+			// Deleting the host end deletes the pair, with its address and route
+			_ = ip("link", "del", host)
+			return netip.Prefix{}, netip.Prefix{}, err
+		}
+	}
+
+	return hostAddress, sandboxAddress, nil
+}
+
+// startVeth creates the virtual ethernet pair and sends the init process the
+// addresses of both ends, so it can configure its own. The init process reads
+// nothing when the pair could not be created.
+func startVeth(pid int, ready *os.File) error {
+	defer ready.Close()
+
+	hostAddress, sandboxAddress, err := createVeth(pid)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(ready, "%s %s", hostAddress, sandboxAddress)
+
+	return err
+}
+
+// joinVeth waits until qo created the virtual ethernet pair, then configures
+// the end inside the sandbox. It runs in the init or check process, before
+// entering the rootfs, so the ip command of the host can be used.
+func joinVeth() error {
+	if Network(os.Getenv(networkEnv)) != NetworkVeth {
+		return nil
+	}
+
+	// The student's shell has no use for it
+	os.Unsetenv(networkEnv)
+
+	ready := os.NewFile(networkFd, "network")
+	data, _ := io.ReadAll(ready)
+	ready.Close()
+
+	addresses := strings.Fields(string(data))
+	if len(addresses) != 2 {
+		return fmt.Errorf("the virtual network of the sandbox could not be created")
+	}
+	hostAddress, err := netip.ParsePrefix(addresses[0])
+	if err != nil {
+		return err
+	}
+
+	if err := ip("addr", "add", addresses[1], "dev", vethSandboxName); err != nil {
+		return err
+	}
+
+	if err := ip("link", "set", vethSandboxName, "up"); err != nil {
+		return err
+	}
+
+	return os.Setenv(hostAddressEnv, hostAddress.Addr().String())
+}
+
+// ip runs the ip command of iproute2
+func ip(args ...string) error {
+	output, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		message := strings.TrimSpace(string(output))
+		if message == "" {
+			message = err.Error()
+		}
+
+		return fmt.Errorf("ip %s: %s", strings.Join(args, " "), message)
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package sandbox
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestFreeVethSubnet(t *testing.T) {
+	prefixes := func(values ...string) []netip.Prefix {
+		var result []netip.Prefix
+		for _, value := range values {
+			result = append(result, netip.MustParsePrefix(value))
+		}
+		return result
+	}
+
+	tests := []struct {
+		name    string
+		pid     int
+		used    []netip.Prefix
+		want    string
+		wantErr bool
+	}{
+		{"derived from the pid", 1, nil, "10.200.0.4/30", false},
+		{"pid beyond the range", 16384 + 65, nil, "10.200.1.4/30", false},
+		{"taken by another sandbox", 65, prefixes("10.200.1.4/30"), "10.200.1.8/30", false},
+		{"overlapping a larger subnet", 65, prefixes("192.168.1.0/24", "10.200.1.0/28"), "10.200.1.16/30", false},
+		{"wrapping around", 16383, prefixes("10.200.255.252/30"), "10.200.0.0/30", false},
+		{"no free subnet", 7, prefixes("10.0.0.0/8"), "", true},
+	}
+
+	for _, test := range tests {
+		got, err := freeVethSubnet(test.pid, test.used)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: picked %s, want an error", test.name, got)
+			}
+			continue
+		}
+
+		if err != nil || got.String() != test.want {
+			t.Errorf("%s: picked %s, %v, want %s", test.name, got, err, test.want)
+		}
+	}
+}
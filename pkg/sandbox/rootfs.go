@@ -7,6 +7,7 @@ import (
 	_ "embed"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -14,33 +15,67 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/ahmedYasserM/qo/pkg/audit"
 	"github.com/ahmedYasserM/qo/pkg/logger"
+	"golang.org/x/sys/unix"
 )
 
 //go:embed rootfs.tar.gz
 var embeddedRootfs []byte
 
-const target = "/tmp"
-
 var (
-	Rootfs      string = filepath.Join(target, "rootfs")
+	// Rootfs is the root of the sandbox, extracted by ExtractRootfs in a
+	// folder of its own for each session
+	Rootfs      string
 	defaultUser string = "ahmed"
+
+	// ChecksDir holds the level check scripts during the session. It is next
+	// to Rootfs, outside the sandbox, and only accessible by the user running qo.
+	ChecksDir string
+
+	// workDir holds Rootfs and ChecksDir, it is removed by RemoveRootfs
+	workDir string
 )
 
+// rootfsEnv gives the sandbox processes the rootfs of the session
+const rootfsEnv = "QO_ROOTFS"
+
+// The sandbox processes are started by qo from /proc/self/exe, see sandboxEnv
+func init() {
+	if rootfs := os.Getenv(rootfsEnv); rootfs != "" {
+		Rootfs = rootfs
+	}
+}
+
+// sandboxEnv is the environment of the sandbox processes, with extra variables
+func sandboxEnv(extra ...string) []string {
+	return append(append(os.Environ(), rootfsEnv+"="+Rootfs), extra...)
+}
+
 // PathExists checks if a file or directory exists.
 func pathExists(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
 }
 
-// ExtractRootfs extracts the tar-archived rootfs folder in /tmp
+// ExtractRootfs extracts the tar-archived rootfs folder to a new Rootfs, in a
+// temporary folder of the session, so that sessions of several users or run
+// at the same time do not share it. The previous one is removed.
 func ExtractRootfs() error {
-	if pathExists(Rootfs) {
-		_ = syscall.Unmount(filepath.Join(Rootfs, "proc"), syscall.MNT_FORCE) // force unmount of /proc to handle possible previous exits using external kill signal
+	if err := RemoveRootfs(); err != nil {
+		return err
+	}
 
-		if err := os.RemoveAll(Rootfs); err != nil {
-			return err
-		}
+	dir, err := os.MkdirTemp("", "qo-")
+	if err != nil {
+		return fmt.Errorf("could not create the sandbox folder: %w", err)
+	}
+	workDir = dir
+	Rootfs = filepath.Join(dir, "rootfs")
+	ChecksDir = filepath.Join(dir, "checks")
+
+	if err := os.Mkdir(ChecksDir, 0700); err != nil {
+		return err
 	}
 
 	gzReader, err := gzip.NewReader(io.NopCloser(bytes.NewReader(embeddedRootfs)))
@@ -60,13 +95,20 @@ func ExtractRootfs() error {
 			return err
 		}
 
-		destPath := filepath.Join(target, header.Name)
+		// Entries are named rootfs/..., the first element is the rootfs itself
+		_, name, _ := strings.Cut(strings.TrimPrefix(header.Name, "./"), "/")
+		destPath := filepath.Join(Rootfs, name)
 
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err := os.MkdirAll(destPath, 0755); err != nil {
 				return err
 			}
+
+			// Keep the modes the student relies on, like the sticky world-writable /tmp
+			if err := os.Chmod(destPath, header.FileInfo().Mode()); err != nil {
+				return err
+			}
 		case tar.TypeReg:
 			if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
 				return err
@@ -91,17 +133,28 @@ func ExtractRootfs() error {
 				return err
 			}
 		}
+
+		// The student's home directory belongs to the student. Without root
+		// everything belongs to the user running qo, the root of the user
+		// namespace of the sandbox, or the student without subordinate ids.
+		// dropToUser gives the home directory to the student.
+		if Rootless() {
+			continue
+		}
+
+		if err := os.Lchown(destPath, header.Uid, header.Gid); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func dropToUser(username string) error {
-	passwdBytes, err := os.ReadFile("/etc/passwd")
+// lookupUser finds the uid, gid and home directory of username in a passwd file
+func lookupUser(passwdPath, username string) (uid, gid int, homeDir string, err error) {
+	passwdBytes, err := os.ReadFile(passwdPath)
 	if err != nil {
-		return err
+		return 0, 0, "", err
 	}
-	var uid, gid int
-	var homeDir string
 	for _, line := range strings.Split(string(passwdBytes), "\n") {
 		if strings.HasPrefix(line, username+":") {
 			parts := strings.Split(line, ":")
@@ -112,8 +165,31 @@ func dropToUser(username string) error {
 		}
 	}
 	if uid == 0 && username != "root" {
-		return fmt.Errorf("user %s not found in chroot /etc/passwd", username)
+		return 0, 0, "", fmt.Errorf("user %s not found in the rootfs /etc/passwd", username)
+	}
+
+	return uid, gid, homeDir, nil
+}
+
+func dropToUser(username string) error {
+	uid, gid, homeDir, err := lookupUser("/etc/passwd", username)
+	if err != nil {
+		return err
+	}
+
+	if err := ownHome(homeDir, uid, gid); err != nil {
+		return err
 	}
+
+	// The student keeps none of the groups of qo. Only a rootless sandbox
+	// without subordinate ids is denied setgroups, the groups of the host
+	// are unmapped in it.
+	if !Rootless() || userIDs() != nil {
+		if err := syscall.Setgroups([]int{}); err != nil {
+			return err
+		}
+	}
+
 	if err := syscall.Setgid(gid); err != nil {
 		return err
 	}
@@ -121,6 +197,14 @@ func dropToUser(username string) error {
 		return err
 	}
 
+	// Without root the process already is the student, setuid kept the
+	// capabilities used to set up the sandbox. Nothing executed from now on may inherit them.
+	if Rootless() {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+			return err
+		}
+	}
+
 	// Set environment variables
 	os.Setenv("HOME", homeDir)
 	os.Setenv("USER", username)
@@ -129,51 +213,239 @@ func dropToUser(username string) error {
 	return nil
 }
 
-func StartSandBox() error {
+// ownHome gives the home directory to the user, when it still belongs to root
+// like in a rootfs extracted without root. Nothing but the files of the
+// rootfs can be in it then.
+func ownHome(homeDir string, uid, gid int) error {
+	info, err := os.Lstat(homeDir)
+	if err != nil {
+		return err
+	}
 
-	if len(os.Args) == 1 && os.Args[0] == "init" {
-		if err := syscall.Chroot(Rootfs); err != nil {
-			return err
-		}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Uid != 0 {
+		return nil
+	}
 
-		if err := os.Chdir("/tmp"); err != nil {
+	return filepath.WalkDir(homeDir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
 			return err
 		}
 
-		if err := syscall.Mount("proc", "/proc", "proc", 0, ""); err != nil {
-			return err
-		}
+		return os.Lchown(path, uid, gid)
+	})
+}
 
-		if err := dropToUser(defaultUser); err != nil {
-			return err
-		}
+// enterRootfs makes the extracted rootfs, with its own /proc, the root of the
+// mount namespace and moves to the directory the challenges are extracted to. Unlike chroot, the
+// host filesystem is detached, so it can not be reached back from the sandbox.
+func enterRootfs() error {
+	// Nothing mounted in the sandbox may propagate to the host, nor the other way around
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making the mounts private: %w", err)
+	}
 
-		logger.Info("You are now inside the isolated enviornemnt.")
+	// The student's shell has no use for the path of the rootfs on the host
+	os.Unsetenv(rootfsEnv)
 
-		cmd := exec.Command("/bin/bash")
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+	// pivot_root needs the new root to be a mount point
+	if err := syscall.Mount(Rootfs, Rootfs, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("bind mounting the rootfs: %w", err)
+	}
 
-		err := cmd.Run()
+	// In a user namespace, proc can only be mounted while the /proc of the host is still visible
+	if err := syscall.Mount("proc", filepath.Join(Rootfs, "proc"), "proc", 0, ""); err != nil {
+		return fmt.Errorf("mounting /proc: %w", err)
+	}
 
+	if err := os.Chdir(Rootfs); err != nil {
 		return err
 	}
 
-	cmd := exec.Command("/proc/self/exe")
-	cmd.Args = []string{"init"}
+	// Stack the old root under the new one, then detach it, see pivot_root(2)
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot_root: %w", err)
+	}
+
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("detaching the old root: %w", err)
+	}
+
+	return os.Chdir("/tmp")
+}
+
+// InitSandBox runs inside the new namespaces: it enters the rootfs, drops to
+// the default user and hands the terminal over to the student's shell.
+func InitSandBox() error {
+	if err := setupLoopback(); err != nil {
+		return err
+	}
+
+	if err := joinVeth(); err != nil {
+		return err
+	}
+
+	if err := enterRootfs(); err != nil {
+		return err
+	}
+
+	auditor, err := startAudit()
+	if err != nil {
+		return err
+	}
+
+	if err := dropToUser(defaultUser); err != nil {
+		return err
+	}
+
+	logger.Info("You are now inside the isolated enviornemnt.")
+	if address := os.Getenv(hostAddressEnv); address != "" {
+		logger.Info(fmt.Sprintf("The lab machine is reachable at %s, also in $%s.", address, hostAddressEnv))
+	}
+
+	// Bash only reads the hook in interactive shells, which it does not start
+	// on the plain pipes qo uses without a real terminal
+	cmd := exec.Command("/bin/bash", "--rcfile", audit.HookPath, "-i")
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
-	}
+	auditor.attach(cmd)
 
+	// A non-zero exit status of the shell is the student's business, not a sandbox failure
 	if err := cmd.Run(); err != nil {
-		return err
+		if _, ok := err.(*exec.ExitError); !ok {
+			return err
+		}
+	}
+
+	auditor.stop()
+
+	return nil
+}
+
+// StartSandBox launches the sandbox in new namespaces and waits until the
+// student leaves the shell or the session time runs out. The shell runs behind
+// a terminal owned by qo so that the session can be recorded.
+func StartSandBox(cfg Config) (ExitReason, error) {
+	recorder := cfg.Recorder
+	if recorder == nil {
+		recorder = noRecorder{}
 	}
 
-	err := syscall.Unmount(Rootfs+"/proc", 0)
+	attr, err := sandboxAttr(cfg.Namespaces)
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkNetwork(cfg.Network, cfg.Namespaces); err != nil {
+		return "", err
+	}
+
+	group, err := limitSandbox("qo", cfg.Limits, cfg.BestEffortLimits, attr)
+	if err != nil {
+		return "", err
+	}
+	if group != nil {
+		logger.Info(fmt.Sprintf("The sandbox is limited to %s.", cfg.Limits))
+		defer group.remove()
+	}
+
+	terminal, err := openTerminal(recorder)
+	if err != nil {
+		return "", err
+	}
+
+	// Command records are forwarded by the init process through this pipe
+	commandsR, commandsW, err := os.Pipe()
+	if err != nil {
+		terminal.release()
+		return "", err
+	}
+	defer commandsR.Close()
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Args = []string{"init"}
+	cmd.Env = sandboxEnv()
+	cmd.ExtraFiles = []*os.File{commandsW} // auditFd in the init process
+	cmd.SysProcAttr = attr
+	terminal.attach(cmd)
+
+	// The init process waits on networkFd until the virtual ethernet pair is created
+	var networkR, networkW *os.File
+	if cfg.Network == NetworkVeth {
+		if networkR, networkW, err = os.Pipe(); err != nil {
+			commandsW.Close()
+			terminal.release()
+			return "", err
+		}
+
+		cmd.Env = append(cmd.Env, networkEnv+"="+string(NetworkVeth))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, networkR)
+	}
+
+	if cfg.Duration > 0 {
+		logger.Info(fmt.Sprintf("The session will end in %s.", cfg.Duration))
+	}
+
+	err = startSandboxProcess(cmd)
+	commandsW.Close()
+	if networkR != nil {
+		networkR.Close()
+	}
+	if err != nil {
+		if networkW != nil {
+			networkW.Close()
+		}
+		terminal.release()
+		return "", err
+	}
+
+	if networkW != nil {
+		if err := startVeth(cmd.Process.Pid, networkW); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			terminal.release()
+			return "", err
+		}
+	}
+
+	type collected struct {
+		skipped int
+		err     error
+	}
+	commands := make(chan collected, 1)
+	go func() {
+		skipped, err := collectCommands(commandsR, cfg.Commands)
+		commands <- collected{skipped, err}
+	}()
+
+	if err := terminal.start(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		terminal.release()
+		return "", err
+	}
+
+	reason, err := waitSession(cmd, cfg)
+	terminal.close()
+	if err != nil {
+		return reason, err
+	}
+
+	if group != nil && cfg.LimitReport != nil {
+		*cfg.LimitReport = LimitReport{Limits: cfg.Limits}
+		if err := group.events(cfg.LimitReport); err != nil {
+			return reason, err
+		}
+	}
+
+	// The command log is for the instructor, the session goes on without it
+	result := <-commands
+	if result.skipped > 0 {
+		logger.Warn(fmt.Sprintf("%d command records were not written by the shell hook, they are left out of the command log.", result.skipped))
+	}
+	if result.err != nil {
+		logger.Error(fmt.Errorf("the command log is incomplete: %w", result.err))
+	}
 
-	return err
+	return reason, nil
 }
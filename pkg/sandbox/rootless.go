@@ -0,0 +1,307 @@
+package sandbox
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ahmedYasserM/qo/pkg/logger"
+	"golang.org/x/sys/unix"
+)
+
+// Capabilities the sandbox processes need in their user namespace to enter the
+// rootfs, mount /proc and bring the loopback interface up when qo does not run
+// as root and has no subordinate ids
+var rootlessCaps = []uintptr{unix.CAP_SYS_ADMIN, unix.CAP_NET_ADMIN}
+
+const (
+	// idMapEnv tells a sandbox process to wait until qo mapped its user namespace
+	idMapEnv = "QO_ID_MAP"
+
+	// idMapFd is the file descriptor, inherited from qo, that is closed once
+	// newuidmap and newgidmap mapped the user namespace
+	idMapFd = 5
+)
+
+// idRange is a range of subordinate ids of /etc/subuid or /etc/subgid
+type idRange struct {
+	start, count int
+}
+
+// subordinateIDs are the ids the user running qo may map in a user namespace
+// with newuidmap and newgidmap
+type subordinateIDs struct {
+	uid, gid idRange
+}
+
+// userIDs returns the subordinate ids of the user running qo, nil when qo runs
+// as root, the user has none or the uidmap tools are not installed
+var userIDs = sync.OnceValue(func() *subordinateIDs {
+	if !Rootless() {
+		return nil
+	}
+
+	for _, tool := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil
+		}
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		return nil
+	}
+
+	uid, err := readSubordinateIDs("/etc/subuid", current.Username, current.Uid)
+	if err != nil {
+		return nil
+	}
+
+	gid, err := readSubordinateIDs("/etc/subgid", current.Username, current.Uid)
+	if err != nil {
+		return nil
+	}
+
+	return &subordinateIDs{uid: uid, gid: gid}
+})
+
+// readSubordinateIDs finds the first range of "<user>:<start>:<count>" lines
+// given to the user, by name or uid
+func readSubordinateIDs(path, name, uid string) (idRange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return idRange{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || fields[0] != name && fields[0] != uid {
+			continue
+		}
+
+		start, startErr := strconv.Atoi(fields[1])
+		count, countErr := strconv.Atoi(fields[2])
+		if startErr == nil && countErr == nil && count > 0 {
+			return idRange{start, count}, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return idRange{}, err
+	}
+
+	return idRange{}, fmt.Errorf("%s gives no ids to %s", path, name)
+}
+
+// Rootless tells whether qo runs without root. The sandbox is then created
+// in a new user namespace, see sandboxAttr.
+func Rootless() bool {
+	return os.Geteuid() != 0
+}
+
+// ErrSharedUser is returned by CheckRootless when the student of a rootless
+// sandbox would be the user running qo
+var ErrSharedUser = errors.New("the user running qo has no subordinate ids in /etc/subuid and /etc/subgid, or newuidmap and newgidmap are not installed, " +
+	"so the student would be the same user as qo: they could read the check scripts and change every file of the sandbox, " +
+	"including the programs the check scripts run")
+
+// CheckRootless makes sure the sandbox can be created by the current user.
+// It starts a process in the namespaces of the sandbox, which fails when the
+// kernel does not allow unprivileged user namespaces. Without subordinate ids
+// it returns ErrSharedUser, unless shared is set: then it only warns.
+func CheckRootless(shared bool) error {
+	if !Rootless() {
+		return nil
+	}
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.Args = []string{"probe"}
+	cmd.SysProcAttr = rootlessAttr(DefaultNamespaces, 0, 0)
+
+	if err := runSandboxProcess(cmd); err != nil {
+		return fmt.Errorf("user namespaces are not available to unprivileged users on this machine, run qo as root: %w", err)
+	}
+
+	if userIDs() != nil {
+		return nil
+	}
+
+	if !shared {
+		return ErrSharedUser
+	}
+
+	logger.Warn("The check scripts and the system files of the sandbox are exposed to the student: " +
+		"without subordinate ids, the student is the user running qo.")
+
+	return nil
+}
+
+// sandboxAttr returns the attributes the sandbox processes are started with,
+// in namespaces. Without root, they also get a new user namespace: with
+// subordinate ids, the user running qo is its root and the default user has
+// an id of its own, otherwise the default user is mapped to the user running qo.
+func sandboxAttr(namespaces []Namespace) (*syscall.SysProcAttr, error) {
+	if !Rootless() {
+		return &syscall.SysProcAttr{Cloneflags: cloneFlags(namespaces)}, nil
+	}
+
+	uid, gid, _, err := lookupUser(filepath.Join(Rootfs, "etc", "passwd"), defaultUser)
+	if err != nil {
+		return nil, err
+	}
+
+	if ids := userIDs(); ids != nil {
+		if uid > ids.uid.count || gid > ids.gid.count {
+			return nil, fmt.Errorf("the subordinate ids of the user running qo do not cover the uid %d and gid %d of %s", uid, gid, defaultUser)
+		}
+	}
+
+	return rootlessAttr(namespaces, uid, gid), nil
+}
+
+// rootlessAttr creates a user namespace. With subordinate ids, it is mapped by
+// runSandboxProcess. Otherwise uid and gid inside it are mapped to the user
+// running qo: the sandbox process is not root there, so it gets the
+// capabilities it needs until dropToUser.
+func rootlessAttr(namespaces []Namespace, uid, gid int) *syscall.SysProcAttr {
+	if userIDs() != nil {
+		return &syscall.SysProcAttr{Cloneflags: cloneFlags(namespaces) | syscall.CLONE_NEWUSER}
+	}
+
+	return &syscall.SysProcAttr{
+		Cloneflags:  cloneFlags(namespaces) | syscall.CLONE_NEWUSER,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: uid, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: gid, HostID: os.Getgid(), Size: 1}},
+
+		// Unprivileged users can only map their group once setgroups is denied
+		GidMappingsEnableSetgroups: false,
+		AmbientCaps:                rootlessCaps,
+	}
+}
+
+// startSandboxProcess starts cmd, a sandbox process. Without root but with
+// subordinate ids, its user namespace is mapped once it started: the user
+// running qo is root there, and the subordinate ids follow from id 1 on.
+func startSandboxProcess(cmd *exec.Cmd) error {
+	ids := userIDs()
+	if ids == nil {
+		return cmd.Start()
+	}
+
+	ready, mapped, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer mapped.Close()
+
+	// ExtraFiles start at file descriptor 3, the ones before idMapFd may be unused
+	for len(cmd.ExtraFiles) < idMapFd-3 {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, nil)
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, ready)
+
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, idMapEnv+"=1")
+
+	err = cmd.Start()
+	ready.Close()
+	if err != nil {
+		return err
+	}
+
+	pid := strconv.Itoa(cmd.Process.Pid)
+	mappings := []struct {
+		tool string
+		id   int
+		sub  idRange
+	}{{"newuidmap", os.Getuid(), ids.uid}, {"newgidmap", os.Getgid(), ids.gid}}
+
+	for _, mapping := range mappings {
+		output, err := exec.Command(mapping.tool, pid,
+			"0", strconv.Itoa(mapping.id), "1",
+			"1", strconv.Itoa(mapping.sub.start), strconv.Itoa(mapping.sub.count)).CombinedOutput()
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("%s: %s", mapping.tool, strings.TrimSpace(string(output)))
+		}
+	}
+
+	_, err = mapped.Write([]byte{1})
+
+	return err
+}
+
+// runSandboxProcess starts cmd with startSandboxProcess and waits for it
+func runSandboxProcess(cmd *exec.Cmd) error {
+	if err := startSandboxProcess(cmd); err != nil {
+		return err
+	}
+
+	return cmd.Wait()
+}
+
+// WaitIDMap runs first in every sandbox process. When its user namespace is
+// mapped by qo, it waits for the mapping and executes itself again: only then
+// is it root in the user namespace, with the capabilities to set up the sandbox.
+func WaitIDMap() error {
+	if os.Getenv(idMapEnv) == "" {
+		return nil
+	}
+	os.Unsetenv(idMapEnv)
+
+	mapped := os.NewFile(idMapFd, "id map")
+	n, _ := io.ReadFull(mapped, make([]byte, 1))
+	mapped.Close()
+
+	if n != 1 {
+		return fmt.Errorf("the user namespace of the sandbox could not be mapped")
+	}
+
+	return syscall.Exec("/proc/self/exe", os.Args, os.Environ())
+}
+
+// RemoveRootfs removes the folder ExtractRootfs created, if any. In rootless
+// sandboxes with subordinate ids, the files of the student belong to those
+// ids: they are removed from a user namespace mapping them.
+func RemoveRootfs() error {
+	if workDir == "" {
+		return nil
+	}
+
+	err := os.RemoveAll(workDir)
+	if err != nil && userIDs() != nil {
+		cmd := exec.Command("/proc/self/exe")
+		cmd.Args = []string{"clean"}
+		cmd.Env = sandboxEnv()
+		cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER}
+
+		if runSandboxProcess(cmd) == nil {
+			err = os.RemoveAll(workDir)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not remove the sandbox %s: %w", workDir, err)
+	}
+
+	workDir = ""
+
+	return nil
+}
+
+// CleanSandBox runs in the user namespace created by RemoveRootfs, as its root
+func CleanSandBox() error {
+	return os.RemoveAll(Rootfs)
+}
@@ -0,0 +1,118 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ahmedYasserM/qo/pkg/audit"
+	"github.com/ahmedYasserM/qo/pkg/logger"
+)
+
+// Config controls how a sandbox session is run.
+type Config struct {
+	// Duration is the total time the student is allowed to stay in the sandbox.
+	// A zero duration means the session only ends when the shell exits.
+	Duration time.Duration
+
+	// Warnings are the remaining-time checkpoints at which the student is warned.
+	Warnings []time.Duration
+
+	// Recorder receives the terminal traffic of the session, it may be nil.
+	Recorder Recorder
+
+	// Commands receives every command line executed by the student, it may be nil.
+	Commands *audit.Log
+
+	// Network is what the sandbox is connected to, the loopback network when empty.
+	Network Network
+
+	// Namespaces the sandbox is isolated in, every namespace when empty.
+	Namespaces []Namespace
+
+	// Limits are the resource limits of the sandbox cgroup, nothing is limited when zero.
+	Limits Limits
+
+	// BestEffortLimits starts the session unlimited, after a warning, when
+	// Limits can not be enforced. It is meant for the defaults of qo, limits
+	// asked for by the instructor have to be enforced.
+	BestEffortLimits bool
+
+	// LimitReport receives the enforced limits and how often the sandbox ran
+	// into them, it may be nil. It is left untouched when the limits could not be enforced.
+	LimitReport *LimitReport
+}
+
+// Check returns the configuration of the check scripts of the session, they
+// are isolated and limited like the student was
+func (c Config) Check(timeout time.Duration) CheckConfig {
+	return CheckConfig{
+		Timeout:          timeout,
+		Network:          c.Network,
+		Namespaces:       c.Namespaces,
+		Limits:           c.Limits,
+		BestEffortLimits: c.BestEffortLimits,
+	}
+}
+
+// ExitReason describes why a sandbox session ended.
+type ExitReason string
+
+const (
+	ExitShell   ExitReason = "shell-exited"
+	ExitTimeout ExitReason = "time-expired"
+	ExitError   ExitReason = "error"
+)
+
+// waitSession waits for the sandbox init process to exit or for the session
+// duration to run out, whichever happens first.
+func waitSession(cmd *exec.Cmd, cfg Config) (ExitReason, error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	// Ctrl-C is meant for the student's shell, it must not kill qo itself
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	var deadline <-chan time.Time
+	if cfg.Duration > 0 {
+		timer := time.NewTimer(cfg.Duration)
+		defer timer.Stop()
+		deadline = timer.C
+
+		for _, left := range cfg.Warnings {
+			if left <= 0 || left >= cfg.Duration {
+				continue
+			}
+
+			warning := time.AfterFunc(cfg.Duration-left, func() {
+				logger.Warn(fmt.Sprintf("%s left before the session ends.", left))
+			})
+			defer warning.Stop()
+		}
+	}
+
+	for {
+		select {
+		case err := <-done:
+			return ExitShell, err
+		case <-deadline:
+			logger.Warn("Time is up, ending the session.")
+
+			// Killing the init process of a PID namespace kills every process inside it
+			if err := cmd.Process.Kill(); err != nil {
+				return ExitTimeout, err
+			}
+			<-done
+
+			return ExitTimeout, nil
+		case <-signals:
+		}
+	}
+}
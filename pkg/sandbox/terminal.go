@@ -0,0 +1,178 @@
+package sandbox
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"github.com/ahmedYasserM/qo/pkg/logger"
+	"github.com/creack/pty"
+	"golang.org/x/term"
+)
+
+// Recorder receives everything that goes through the student's terminal
+type Recorder interface {
+	Input(p []byte)
+	Output(p []byte)
+	Resize(width, height int)
+}
+
+// terminal connects the student's shell to streams owned by qo, so everything
+// typed and printed can be recorded. When qo runs in a real terminal the shell
+// gets a pseudo-terminal, otherwise plain pipes.
+type terminal struct {
+	in       *os.File // written by qo, read by the shell
+	out      *os.File // written by the shell, read by qo
+	childIn  *os.File
+	childOut *os.File
+	isPty    bool
+
+	recorder Recorder
+	state    *term.State // state of the real terminal before switching it to raw mode
+	resize   chan os.Signal
+	output   chan struct{} // closed once the shell output is fully copied
+}
+
+// recordFunc adapts a Recorder method to an io.Writer
+type recordFunc func(p []byte)
+
+func (f recordFunc) Write(p []byte) (int, error) {
+	f(p)
+	return len(p), nil
+}
+
+func openTerminal(recorder Recorder) (*terminal, error) {
+	t := &terminal{
+		recorder: recorder,
+		resize:   make(chan os.Signal, 1),
+		output:   make(chan struct{}),
+	}
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		ptmx, tty, err := pty.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		t.in, t.out = ptmx, ptmx
+		t.childIn, t.childOut = tty, tty
+		t.isPty = true
+
+		return t, nil
+	}
+
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+
+	t.in, t.out = inW, outR
+	t.childIn, t.childOut = inR, outW
+
+	return t, nil
+}
+
+// attach makes the terminal the standard streams of cmd, and its controlling
+// terminal when it is a pseudo-terminal.
+func (t *terminal) attach(cmd *exec.Cmd) {
+	cmd.Stdin = t.childIn
+	cmd.Stdout = t.childOut
+	cmd.Stderr = t.childOut
+
+	if t.isPty {
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+	}
+}
+
+// start forwards the real terminal to the shell. It must be called once the
+// command is started.
+func (t *terminal) start() error {
+	// Only the shell should keep its ends open, so reading fails once it is gone
+	t.childIn.Close()
+	if t.childOut != t.childIn {
+		t.childOut.Close()
+	}
+
+	if t.isPty {
+		signal.Notify(t.resize, syscall.SIGWINCH)
+		go t.forwardResize()
+		t.resize <- syscall.SIGWINCH // initial size
+
+		state, err := term.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		t.state = state
+		logger.SetRawTerminal(true)
+	}
+
+	go func() {
+		io.Copy(io.MultiWriter(t.in, recordFunc(t.recorder.Input)), os.Stdin)
+
+		// Input ran out, let the shell see the end of file
+		if !t.isPty {
+			t.in.Close()
+		}
+	}()
+
+	go func() {
+		io.Copy(io.MultiWriter(os.Stdout, recordFunc(t.recorder.Output)), t.out)
+		close(t.output)
+	}()
+
+	return nil
+}
+
+func (t *terminal) forwardResize() {
+	for range t.resize {
+		if err := pty.InheritSize(os.Stdin, t.out); err != nil {
+			continue
+		}
+
+		if width, height, err := term.GetSize(int(os.Stdin.Fd())); err == nil && width > 0 && height > 0 {
+			t.recorder.Resize(width, height)
+		}
+	}
+}
+
+// close waits for the remaining shell output and gives the real terminal back
+// its original state. It must be called once the command exited.
+func (t *terminal) close() {
+	<-t.output
+
+	signal.Stop(t.resize)
+	close(t.resize)
+
+	if t.state != nil {
+		term.Restore(int(os.Stdin.Fd()), t.state)
+		logger.SetRawTerminal(false)
+	}
+
+	t.in.Close()
+	t.out.Close()
+}
+
+// release closes every end of the terminal when the command could not be started
+func (t *terminal) release() {
+	t.childIn.Close()
+	t.childOut.Close()
+	t.in.Close()
+	t.out.Close()
+}
+
+// noRecorder is used when the session is not recorded
+type noRecorder struct{}
+
+func (noRecorder) Input(p []byte)           {}
+func (noRecorder) Output(p []byte)          {}
+func (noRecorder) Resize(width, height int) {}
@@ -0,0 +1,200 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ahmedYasserM/qo/pkg/audit"
+	"github.com/ahmedYasserM/qo/pkg/logger"
+	"github.com/ahmedYasserM/qo/pkg/recording"
+	"github.com/ahmedYasserM/qo/pkg/sandbox"
+)
+
+// Session is the record of a single student test session, saved as session.json
+type Session struct {
+	StudentID          uint64        `json:"student_id"`
+	Archive            string        `json:"archive"`
+	ArchiveSHA256      string        `json:"archive_sha256"`
+	StartedAt          time.Time     `json:"started_at"`
+	EndedAt            time.Time     `json:"ended_at"`
+	ExitReason         string        `json:"exit_reason"`
+	Error              string        `json:"error,omitempty"`
+	Recording          string        `json:"recording,omitempty"`
+	Commands           string        `json:"commands,omitempty"`
+	CommandCount       int           `json:"command_count"`
+	FailedCommandCount int           `json:"failed_command_count"`
+	Report             string        `json:"report,omitempty"`
+	Title              string        `json:"title,omitempty"`
+	Points             int           `json:"points,omitempty"`
+	MaxPoints          int           `json:"max_points,omitempty"`
+	Levels             []LevelResult `json:"levels"`
+
+	// Limits are the resource limits of the sandbox and how often the student
+	// ran into them, absent when the sandbox was not limited
+	Limits *sandbox.LimitReport `json:"resource_limits,omitempty"`
+}
+
+// LevelResult is the outcome of running the check script of one level
+type LevelResult struct {
+	Level      string        `json:"level"`
+	Title      string        `json:"title,omitempty"`
+	Passed     bool          `json:"passed"`
+	Points     int           `json:"points,omitempty"`
+	MaxPoints  int           `json:"max_points,omitempty"`
+	SkippedFor []string      `json:"skipped_for,omitempty"` // dependencies that did not pass, the check was not run
+	ExitCode   int           `json:"exit_code"`
+	TimedOut   bool          `json:"timed_out,omitempty"`
+	Duration   time.Duration `json:"duration_ns"`
+	StdoutFile string        `json:"stdout_file"`
+	StderrFile string        `json:"stderr_file"`
+}
+
+// Bundle is the results directory of a session.
+//
+// Layout:
+//
+//	<output>/<student id>-<start time>/
+//	├── session.json
+//	├── qo.log
+//	├── session.cast
+//	├── commands.jsonl
+//	├── report.pdf
+//	└── checks/
+//	    ├── <level>.stdout
+//	    └── <level>.stderr
+type Bundle struct {
+	Dir      string
+	Session  Session
+	logFile  *os.File
+	commands *audit.Log
+}
+
+// Create makes a new results directory for the student under root and starts
+// capturing the logger output into it.
+func Create(root string, studentID uint64, archivePath string) (*Bundle, error) {
+	start := time.Now()
+	dir := filepath.Join(root, fmt.Sprintf("%d-%s", studentID, start.Format("20060102-150405")))
+
+	if err := os.MkdirAll(filepath.Join(dir, "checks"), 0755); err != nil {
+		return nil, err
+	}
+
+	hash, err := hashFile(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.Create(filepath.Join(dir, "qo.log"))
+	if err != nil {
+		return nil, err
+	}
+	logger.Capture(logFile)
+
+	return &Bundle{
+		Dir: dir,
+		Session: Session{
+			StudentID:     studentID,
+			Archive:       filepath.Base(archivePath),
+			ArchiveSHA256: hash,
+			StartedAt:     start,
+			Levels:        []LevelResult{},
+		},
+		logFile: logFile,
+	}, nil
+}
+
+// CreateRecording starts the asciicast recording of the student's terminal
+func (b *Bundle) CreateRecording(width, height int) (*recording.Cast, error) {
+	cast, err := recording.Create(filepath.Join(b.Dir, "session.cast"), fmt.Sprintf("Student %d", b.Session.StudentID), width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	b.Session.Recording = "session.cast"
+
+	return cast, nil
+}
+
+// CreateCommandLog starts the log of the command lines executed by the student
+func (b *Bundle) CreateCommandLog() (*audit.Log, error) {
+	log, err := audit.Create(filepath.Join(b.Dir, "commands.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	b.Session.Commands = "commands.jsonl"
+	b.commands = log
+
+	return log, nil
+}
+
+// AddLevel records the result of a level and saves the output of its check script
+func (b *Bundle) AddLevel(result LevelResult, stdout, stderr []byte) error {
+	result.StdoutFile = filepath.Join("checks", result.Level+".stdout")
+	if err := os.WriteFile(filepath.Join(b.Dir, result.StdoutFile), stdout, 0644); err != nil {
+		return err
+	}
+
+	result.StderrFile = filepath.Join("checks", result.Level+".stderr")
+	if err := os.WriteFile(filepath.Join(b.Dir, result.StderrFile), stderr, 0644); err != nil {
+		return err
+	}
+
+	b.Session.Levels = append(b.Session.Levels, result)
+	b.Session.Points += result.Points
+
+	return nil
+}
+
+// End stamps the end of the session. A non-nil sessionErr is recorded as the
+// reason the session failed.
+func (b *Bundle) End(reason string, sessionErr error) {
+	b.Session.EndedAt = time.Now()
+	if b.commands != nil {
+		b.Session.CommandCount = b.commands.Count
+		b.Session.FailedCommandCount = b.commands.Failed
+	}
+	b.Session.ExitReason = reason
+	if sessionErr != nil {
+		b.Session.Error = sessionErr.Error()
+	}
+}
+
+// Close writes session.json and stops capturing logs
+func (b *Bundle) Close() error {
+
+	data, err := json.MarshalIndent(b.Session, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(b.Dir, "session.json"), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+
+	logger.Capture(nil)
+
+	return b.logFile.Close()
+}
+
+// hashFile returns the hex encoded SHA-256 digest of a file
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -10,8 +10,8 @@ echo "Creating challenge folder: $CHALLENGE_DIR"
 
 # Level 1
 mkdir -p "$CHALLENGE_DIR/level1"
-# Add question.txt
-cat <<'EOF' > "$CHALLENGE_DIR/level1/question.txt"
+# Add description.md
+cat <<'EOF' > "$CHALLENGE_DIR/level1/description.md"
 Level 1 Challenge:
 ------------------
 Create a directory called "testdir" in your current working directory.
@@ -36,8 +36,8 @@ chmod +x "$CHALLENGE_DIR/level1/check.sh"
 
 # Level 2
 mkdir -p "$CHALLENGE_DIR/level2"
-# Add question.txt
-cat <<'EOF' > "$CHALLENGE_DIR/level2/question.txt"
+# Add description.md
+cat <<'EOF' > "$CHALLENGE_DIR/level2/description.md"
 Level 2 Challenge:
 ------------------
 Create a new user named "studentuser" on the system.
@@ -62,8 +62,8 @@ chmod +x "$CHALLENGE_DIR/level2/check.sh"
 
 # Level 3
 mkdir -p "$CHALLENGE_DIR/level3"
-# Add question.txt
-cat <<'EOF' > "$CHALLENGE_DIR/level3/question.txt"
+# Add description.md
+cat <<'EOF' > "$CHALLENGE_DIR/level3/description.md"
 Level 3 Challenge:
 ------------------
 Copy the file "secret.txt" from this folder to your home directory and